@@ -0,0 +1,91 @@
+package kafkaadapt
+
+import (
+	"sort"
+	"sync"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+type partitionKey struct {
+	topic     string
+	partition int
+}
+
+//ackTracker tracks in-flight offsets of async acked messages by partition
+//and returns offsets, which can be safely committed
+type ackTracker struct {
+	partitions map[partitionKey]*partitionAcks
+	m          sync.Mutex
+}
+
+type partitionAcks struct {
+	//fetched, but not committed offsets in ascending order
+	offsets []int64
+	//acked flags of fetched offsets
+	acked map[int64]bool
+}
+
+func newAckTracker() *ackTracker {
+	return &ackTracker{
+		partitions: make(map[partitionKey]*partitionAcks),
+	}
+}
+
+//track registers fetched message as in-flight
+func (t *ackTracker) track(msg *kafka.Message) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	key := partitionKey{topic: msg.Topic, partition: msg.Partition}
+	p, ok := t.partitions[key]
+	if !ok {
+		p = &partitionAcks{acked: make(map[int64]bool)}
+		t.partitions[key] = p
+	}
+	if _, ok := p.acked[msg.Offset]; ok {
+		return
+	}
+	p.acked[msg.Offset] = false
+	i := sort.Search(len(p.offsets), func(i int) bool { return p.offsets[i] >= msg.Offset })
+	p.offsets = append(p.offsets, 0)
+	copy(p.offsets[i+1:], p.offsets[i:])
+	p.offsets[i] = msg.Offset
+}
+
+//ack marks message as acked and returns message with the highest offset of contiguous acked prefix.
+//returns false if there is nothing to commit.
+func (t *ackTracker) ack(msg *kafka.Message) (kafka.Message, bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	key := partitionKey{topic: msg.Topic, partition: msg.Partition}
+	p, ok := t.partitions[key]
+	if !ok {
+		return kafka.Message{}, false
+	}
+	if _, ok := p.acked[msg.Offset]; !ok {
+		return kafka.Message{}, false
+	}
+	p.acked[msg.Offset] = true
+
+	commit := int64(-1)
+	for len(p.offsets) > 0 && p.acked[p.offsets[0]] {
+		commit = p.offsets[0]
+		delete(p.acked, commit)
+		p.offsets = p.offsets[1:]
+	}
+	if commit < 0 {
+		return kafka.Message{}, false
+	}
+	return kafka.Message{Topic: msg.Topic, Partition: msg.Partition, Offset: commit}, true
+}
+
+//forget drops tracked offsets of topic
+func (t *ackTracker) forget(topic string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	for key := range t.partitions {
+		if key.topic == topic {
+			delete(t.partitions, key)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package kafkaadapt
+
+import (
+	"testing"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+func trackedMessage(t *ackTracker, partition int, offset int64) *kafka.Message {
+	msg := &kafka.Message{Topic: "orders", Partition: partition, Offset: offset}
+	t.track(msg)
+	return msg
+}
+
+func TestAckTrackerCommitsContiguousPrefix(t *testing.T) {
+	tr := newAckTracker()
+	msgs := make([]*kafka.Message, 5)
+	for i := range msgs {
+		msgs[i] = trackedMessage(tr, 0, int64(10+i))
+	}
+
+	//подтверждение не по порядку не должно коммитить дальше первого неподтвержденного
+	if _, ok := tr.ack(msgs[2]); ok {
+		t.Fatal("ack of offset 12 must not commit while 10 is in-flight")
+	}
+	if _, ok := tr.ack(msgs[1]); ok {
+		t.Fatal("ack of offset 11 must not commit while 10 is in-flight")
+	}
+	commit, ok := tr.ack(msgs[0])
+	if !ok || commit.Offset != 12 || commit.Topic != "orders" || commit.Partition != 0 {
+		t.Fatalf("ack of offset 10 must commit up to 12, got %v %v", commit.Offset, ok)
+	}
+	if _, ok := tr.ack(msgs[4]); ok {
+		t.Fatal("ack of offset 14 must not commit while 13 is in-flight")
+	}
+	commit, ok = tr.ack(msgs[3])
+	if !ok || commit.Offset != 14 {
+		t.Fatalf("ack of offset 13 must commit up to 14, got %v %v", commit.Offset, ok)
+	}
+}
+
+func TestAckTrackerPartitionsAreIndependent(t *testing.T) {
+	tr := newAckTracker()
+	p0 := trackedMessage(tr, 0, 1)
+	trackedMessage(tr, 0, 2)
+	p1 := trackedMessage(tr, 1, 7)
+
+	commit, ok := tr.ack(p1)
+	if !ok || commit.Partition != 1 || commit.Offset != 7 {
+		t.Fatalf("partition 1 must be committed independently, got %v[%v] %v", commit.Partition, commit.Offset, ok)
+	}
+	commit, ok = tr.ack(p0)
+	if !ok || commit.Partition != 0 || commit.Offset != 1 {
+		t.Fatalf("partition 0 must be committed up to 1, got %v[%v] %v", commit.Partition, commit.Offset, ok)
+	}
+}
+
+func TestAckTrackerRedeliveredMessage(t *testing.T) {
+	tr := newAckTracker()
+	first := trackedMessage(tr, 0, 1)
+	second := trackedMessage(tr, 0, 2)
+	//повторно доставленное сообщение отслеживается один раз
+	tr.track(first)
+
+	if _, ok := tr.ack(second); ok {
+		t.Fatal("ack of offset 2 must not commit while nacked offset 1 is in-flight")
+	}
+	commit, ok := tr.ack(first)
+	if !ok || commit.Offset != 2 {
+		t.Fatalf("ack of redelivered offset 1 must commit up to 2, got %v %v", commit.Offset, ok)
+	}
+	if _, ok := tr.ack(first); ok {
+		t.Fatal("repeated ack must not commit again")
+	}
+}
+
+func TestAckTrackerUntrackedAndForget(t *testing.T) {
+	tr := newAckTracker()
+	if _, ok := tr.ack(&kafka.Message{Topic: "orders", Offset: 1}); ok {
+		t.Fatal("ack of untracked message must not commit")
+	}
+	msg := trackedMessage(tr, 0, 1)
+	tr.forget("orders")
+	if _, ok := tr.ack(msg); ok {
+		t.Fatal("ack of forgotten topic must not commit")
+	}
+}
@@ -0,0 +1,118 @@
+package kafkaadapt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+//Batch is a set of messages, received by GetBatchWithCtx
+type Batch struct {
+	Messages []*Message
+}
+
+//GetBatchWithCtx collects up to maxMessages messages from topic during maxWait.
+//Messages of batch don't hold readers even in sync mode, their offsets are tracked as in async ack mode,
+//so batch can be larger than Concurrency.
+//Returns empty batch if there were no messages during maxWait.
+func (q *Queue) GetBatchWithCtx(ctx context.Context, queue string, maxMessages int, maxWait time.Duration) (*Batch, error) {
+	select {
+	case <-q.closed:
+		return nil, ErrClosed
+	default:
+
+	}
+
+	q.m.RLock()
+	mch, ok := q.messages[queue]
+	q.m.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("there is no such topic declared in config: %v", queue)
+	}
+
+	t := time.NewTimer(maxWait)
+	defer t.Stop()
+	b := &Batch{}
+	for len(b.Messages) < maxMessages {
+		select {
+		case <-ctx.Done():
+			if len(b.Messages) > 0 {
+				return b, nil
+			}
+			return nil, context.Canceled
+		case <-q.closed:
+			if len(b.Messages) > 0 {
+				return b, nil
+			}
+			return nil, ErrClosed
+		case <-t.C:
+			return b, nil
+		case msg, ok := <-mch:
+			if !ok {
+				if len(b.Messages) > 0 {
+					return b, nil
+				}
+				return nil, ErrUnregistered
+			}
+			msg.detach()
+			b.Messages = append(b.Messages, msg)
+		}
+	}
+	return b, nil
+}
+
+//AckAll acks all messages of batch, committing offsets once per partition
+func (b *Batch) AckAll() error {
+	type partitionCommit struct {
+		msg    kafka.Message
+		tr     *topicReaders
+		reader *kafka.Reader
+		q      *Queue
+	}
+	commits := make(map[partitionKey]partitionCommit)
+	var errs []string
+	for _, msg := range b.Messages {
+		if !msg.lease.claim() {
+			errs = append(errs, fmt.Sprintf("%v[%v] at offset %v: %v", msg.Topic(), msg.Partition(), msg.Offset(), ErrLeaseExpired))
+			continue
+		}
+		commit, ok := msg.settle(true)
+		if !ok {
+			continue
+		}
+		key := partitionKey{topic: commit.Topic, partition: commit.Partition}
+		if c, ok := commits[key]; ok && c.msg.Offset >= commit.Offset {
+			continue
+		}
+		commits[key] = partitionCommit{msg: commit, tr: msg.tr, reader: msg.reader, q: msg.q}
+	}
+
+	for _, c := range commits {
+		err := c.q.commitMessages(context.Background(), c.tr, c.reader, c.msg)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%v[%v]: %v", c.msg.Topic, c.msg.Partition, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("cant commit batch offsets: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+//NackAll nacks all messages of batch
+func (b *Batch) NackAll() error {
+	var errs []string
+	for _, msg := range b.Messages {
+		err := msg.Nack()
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("cant nack batch messages: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
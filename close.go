@@ -0,0 +1,77 @@
+package kafkaadapt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+//CloseWithCtx closes queue gracefully: stops fetching messages, waits until in-flight messages are acked/nacked,
+//closes readers (committing pending async offsets) and flushes writers, then closes queue as Close does.
+//Puts are available until readers are drained, so message handlers can finish their work.
+//Returns error, listing what was left undone when ctx was closed. Queue is closed anyway.
+func (q *Queue) CloseWithCtx(ctx context.Context) error {
+	q.m.Lock()
+	select {
+	case <-q.closing:
+		q.m.Unlock()
+		return ErrClosed
+	default:
+		close(q.closing)
+	}
+	q.m.Unlock()
+	defer q.Close()
+
+	q.adminLock.Lock()
+	q.m.RLock()
+	trs := make([]*topicReaders, 0, len(q.readers))
+	for _, tr := range q.readers {
+		trs = append(trs, tr)
+	}
+	members := make([]*groupMember, 0, len(q.members))
+	for _, m := range q.members {
+		members = append(members, m)
+	}
+	q.m.RUnlock()
+
+	var errs []string
+	for _, tr := range trs {
+		tr.halt()
+	}
+	for _, tr := range trs {
+		// закрытие ридера коммитит накопленные в асинхронном режиме оффсеты
+		err := q.drainReaders(ctx, tr)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	q.adminLock.Unlock()
+	//участники группы выходят из нее после коммита подтверждений in-flight сообщений
+	for _, m := range members {
+		m.halt()
+	}
+	for _, m := range members {
+		err := m.wait(ctx)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	q.m.RLock()
+	topics := make([]string, 0, len(q.writers))
+	for topic := range q.writers {
+		topics = append(topics, topic)
+	}
+	q.m.RUnlock()
+	for _, topic := range topics {
+		err := q.WriterUnregisterWithCtx(ctx, topic)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("queue is closed, but not drained: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
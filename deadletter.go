@@ -0,0 +1,157 @@
+package kafkaadapt
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+//headers, attached to message copy in dead-letter topic
+const (
+	HeaderOriginalTopic     = "x-original-topic"
+	HeaderOriginalPartition = "x-original-partition"
+	HeaderOriginalOffset    = "x-original-offset"
+	HeaderFailureCount      = "x-failure-count"
+	HeaderLastError         = "x-last-error"
+)
+
+type DeadLetterPolicy struct {
+	//count of nacks, after which message is routed to DeadLetterTopic
+	//delivery count is tracked in-process, so it's reset on restart
+	MaxDeliveries int
+
+	//topic, which receives failed messages, writer for it is registered automatically
+	DeadLetterTopic string
+}
+
+type deliveryKey struct {
+	topic     string
+	partition int
+	offset    int64
+}
+
+func keyOf(msg *kafka.Message) deliveryKey {
+	return deliveryKey{
+		topic:     msg.Topic,
+		partition: msg.Partition,
+		offset:    msg.Offset,
+	}
+}
+
+//deadLetter counts nack of msg and publishes its copy to dead-letter topic if limit is reached.
+//returns true if message was published and has to be acked.
+func (q *Queue) deadLetter(msg *kafka.Message, reason error) (bool, error) {
+	policy, ok := q.cfg.DeadLetterPolicies[msg.Topic]
+	if !ok || policy.MaxDeliveries < 1 || policy.DeadLetterTopic == "" {
+		return false, nil
+	}
+	key := keyOf(msg)
+	q.deliveryLock.Lock()
+	q.deliveries[key]++
+	count := q.deliveries[key]
+	q.deliveryLock.Unlock()
+	if count < policy.MaxDeliveries {
+		return false, nil
+	}
+	err := q.publishFailed(msg, policy.DeadLetterTopic, count, reason)
+	return err == nil, err
+}
+
+//publishFailed publishes copy of failed msg to topic with routing headers.
+//original topic, partition and offset are kept if msg was already rerouted.
+func (q *Queue) publishFailed(msg *kafka.Message, topic string, failures int, reason error, extra ...Header) error {
+	origTopic := []byte(msg.Topic)
+	origPartition := []byte(strconv.Itoa(msg.Partition))
+	origOffset := []byte(strconv.FormatInt(msg.Offset, 10))
+	if v := lastHeader(msg.Headers, HeaderOriginalTopic); v != nil {
+		origTopic = v
+		origPartition = lastHeader(msg.Headers, HeaderOriginalPartition)
+		origOffset = lastHeader(msg.Headers, HeaderOriginalOffset)
+	}
+	var lastErr string
+	if reason != nil {
+		lastErr = reason.Error()
+	}
+
+	headers := make([]Header, 0, len(msg.Headers)+5+len(extra))
+	for _, h := range msg.Headers {
+		if !isRoutingHeader(h.Key) {
+			headers = append(headers, h)
+		}
+	}
+	headers = append(headers,
+		Header{Key: HeaderOriginalTopic, Value: origTopic},
+		Header{Key: HeaderOriginalPartition, Value: origPartition},
+		Header{Key: HeaderOriginalOffset, Value: origOffset},
+		Header{Key: HeaderFailureCount, Value: []byte(strconv.Itoa(failures))},
+		Header{Key: HeaderLastError, Value: []byte(lastErr)},
+	)
+	headers = append(headers, extra...)
+	err := q.writeRouted(context.Background(), topic, kafka.Message{
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	})
+	if err != nil {
+		return fmt.Errorf("cant publish message from %v at offset %v to %v: %v", msg.Topic, msg.Offset, topic, err)
+	}
+	return nil
+}
+
+//writeRouted writes copy of failed message, which original is acked right after it.
+//async writers don't report delivery errors, so in Async mode message is written by dedicated synchronous writer.
+func (q *Queue) writeRouted(ctx context.Context, topic string, msg kafka.Message) error {
+	if !q.cfg.Async {
+		return q.writeMessages(ctx, topic, msg)
+	}
+	select {
+	case <-q.closed:
+		return ErrClosed
+	default:
+	}
+	q.m.Lock()
+	w, ok := q.routeWriters[topic]
+	if !ok {
+		w = q.newWriter(topic, false)
+		q.routeWriters[topic] = w
+	}
+	q.m.Unlock()
+	err := w.WriteMessages(ctx, msg)
+	if err != nil {
+		return fmt.Errorf("error during writing Message to kafka: %v", err)
+	}
+	return nil
+}
+
+//closeRouteWriter closes synchronous writer of dead-letter or retry topic, if it was created
+func (q *Queue) closeRouteWriter(topic string) {
+	q.m.Lock()
+	w, ok := q.routeWriters[topic]
+	delete(q.routeWriters, topic)
+	q.m.Unlock()
+	if !ok {
+		return
+	}
+	err := w.Close()
+	if err != nil {
+		q.logger.Errorf("err during writer closing: %v", err)
+	}
+}
+
+func isRoutingHeader(name string) bool {
+	switch name {
+	case HeaderOriginalTopic, HeaderOriginalPartition, HeaderOriginalOffset,
+		HeaderFailureCount, HeaderLastError, HeaderRetryDue:
+		return true
+	}
+	return false
+}
+
+//forgetDeliveries drops nack counter of acked message
+func (q *Queue) forgetDeliveries(msg *kafka.Message) {
+	q.deliveryLock.Lock()
+	delete(q.deliveries, keyOf(msg))
+	q.deliveryLock.Unlock()
+}
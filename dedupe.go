@@ -0,0 +1,285 @@
+package kafkaadapt
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+//DedupeStore remembers ids of processed messages, see KafkaCfg.DedupeStore.
+//topic is the original topic of message, so retried copies share ids with it.
+type DedupeStore interface {
+	//Seen reports whether message id was marked before and not expired yet
+	Seen(topic, id string) (bool, error)
+	//Mark remembers id of processed message
+	Mark(topic, id string) error
+}
+
+//dedupeID returns id of message for DedupeStore, ok is false if message has no id
+func (q *Queue) dedupeID(msg *kafka.Message) (topic, id string, ok bool) {
+	topic = msg.Topic
+	if v := lastHeader(msg.Headers, HeaderOriginalTopic); v != nil {
+		topic = string(v)
+	}
+	value := msg.Key
+	if q.cfg.DedupeHeader != "" {
+		value = lastHeader(msg.Headers, q.cfg.DedupeHeader)
+	}
+	if len(value) == 0 {
+		return "", "", false
+	}
+	return topic, string(value), true
+}
+
+//duplicate reports whether message was already processed.
+//store errors are logged and message is treated as new one.
+func (q *Queue) duplicate(msg *kafka.Message) bool {
+	if q.cfg.DedupeStore == nil {
+		return false
+	}
+	topic, id, ok := q.dedupeID(msg)
+	if !ok {
+		return false
+	}
+	seen, err := q.cfg.DedupeStore.Seen(topic, id)
+	if err != nil {
+		q.logger.Errorf("cant check message %v from %v: %v", id, msg.Topic, err)
+		return false
+	}
+	if seen {
+		atomic.AddInt64(&q.stats.topic(msg.Topic).duplicates, 1)
+	}
+	return seen
+}
+
+//markProcessed remembers id of acked message
+func (q *Queue) markProcessed(msg *kafka.Message) {
+	if q.cfg.DedupeStore == nil {
+		return
+	}
+	topic, id, ok := q.dedupeID(msg)
+	if !ok {
+		return
+	}
+	err := q.cfg.DedupeStore.Mark(topic, id)
+	if err != nil {
+		q.logger.Errorf("cant mark message %v from %v as processed: %v", id, msg.Topic, err)
+	}
+}
+
+type dedupeKey struct {
+	Topic string `json:"t"`
+	ID    string `json:"id"`
+}
+
+type dedupeEntry struct {
+	dedupeKey
+	Expires int64 `json:"e"`
+}
+
+//MemoryDedupeStore keeps up to size last marked ids for ttl in memory
+type MemoryDedupeStore struct {
+	size    int
+	ttl     time.Duration
+	entries map[dedupeKey]*list.Element
+	//least recently marked ids are at the back
+	lru *list.List
+	m   sync.Mutex
+}
+
+//NewMemoryDedupeStore creates store of size ids, each one is forgotten after ttl (never if ttl is 0)
+func NewMemoryDedupeStore(size int, ttl time.Duration) *MemoryDedupeStore {
+	return &MemoryDedupeStore{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[dedupeKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (s *MemoryDedupeStore) Seen(topic, id string) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	el, ok := s.entries[dedupeKey{Topic: topic, ID: id}]
+	if !ok {
+		return false, nil
+	}
+	if s.expired(el.Value.(*dedupeEntry), time.Now()) {
+		s.remove(el)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *MemoryDedupeStore) Mark(topic, id string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.add(dedupeKey{Topic: topic, ID: id}, s.expiry(time.Now()))
+	return nil
+}
+
+//expiry returns expiration time of id, marked at now, 0 means never
+func (s *MemoryDedupeStore) expiry(now time.Time) int64 {
+	if s.ttl <= 0 {
+		return 0
+	}
+	return now.Add(s.ttl).UnixNano()
+}
+
+func (s *MemoryDedupeStore) expired(e *dedupeEntry, now time.Time) bool {
+	return e.Expires != 0 && e.Expires <= now.UnixNano()
+}
+
+//add marks id, evicting least recently marked ids over size, must be called under s.m
+func (s *MemoryDedupeStore) add(key dedupeKey, expires int64) {
+	if el, ok := s.entries[key]; ok {
+		el.Value.(*dedupeEntry).Expires = expires
+		s.lru.MoveToFront(el)
+		return
+	}
+	s.entries[key] = s.lru.PushFront(&dedupeEntry{dedupeKey: key, Expires: expires})
+	for s.size > 0 && s.lru.Len() > s.size {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *MemoryDedupeStore) remove(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.entries, el.Value.(*dedupeEntry).dedupeKey)
+}
+
+//live returns not expired entries from the least recently marked one, must be called under s.m
+func (s *MemoryDedupeStore) live(now time.Time) []*dedupeEntry {
+	res := make([]*dedupeEntry, 0, s.lru.Len())
+	for el := s.lru.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*dedupeEntry)
+		if !s.expired(e, now) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+//FileDedupeStore keeps ids in memory as MemoryDedupeStore and appends them to file,
+//so they survive restart. File is compacted on start and when it grows twice as large as store.
+type FileDedupeStore struct {
+	mem   *MemoryDedupeStore
+	path  string
+	file  *os.File
+	lines int
+}
+
+//NewFileDedupeStore loads not expired ids from file at path, missing file is created
+func NewFileDedupeStore(path string, size int, ttl time.Duration) (*FileDedupeStore, error) {
+	s := &FileDedupeStore{
+		mem:  NewMemoryDedupeStore(size, ttl),
+		path: path,
+	}
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cant open dedupe file %v: %v", path, err)
+	}
+	if err == nil {
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var e dedupeEntry
+			err := json.Unmarshal(sc.Bytes(), &e)
+			if err != nil {
+				//недописанная при падении строка
+				continue
+			}
+			s.mem.add(e.dedupeKey, e.Expires)
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cant read dedupe file %v: %v", path, err)
+		}
+	}
+	err = s.compact()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileDedupeStore) Seen(topic, id string) (bool, error) {
+	return s.mem.Seen(topic, id)
+}
+
+func (s *FileDedupeStore) Mark(topic, id string) error {
+	s.mem.m.Lock()
+	defer s.mem.m.Unlock()
+	key := dedupeKey{Topic: topic, ID: id}
+	expires := s.mem.expiry(time.Now())
+	s.mem.add(key, expires)
+	if s.lines > 2*s.mem.lru.Len() && s.lines > 1000 {
+		return s.compact()
+	}
+	data, err := json.Marshal(dedupeEntry{dedupeKey: key, Expires: expires})
+	if err != nil {
+		return fmt.Errorf("cant marshal dedupe entry: %v", err)
+	}
+	_, err = s.file.Write(append(data, '\n'))
+	if err != nil {
+		return fmt.Errorf("cant write dedupe file %v: %v", s.path, err)
+	}
+	s.lines++
+	return nil
+}
+
+//compact rewrites file with not expired ids only, must be called under s.mem.m or before store is shared
+func (s *FileDedupeStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("cant create dedupe file %v: %v", tmp, err)
+	}
+	w := bufio.NewWriter(f)
+	live := s.mem.live(time.Now())
+	for _, e := range live {
+		data, err := json.Marshal(e)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("cant marshal dedupe entry: %v", err)
+		}
+		w.Write(append(data, '\n'))
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("cant write dedupe file %v: %v", tmp, err)
+	}
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		return fmt.Errorf("cant replace dedupe file %v: %v", s.path, err)
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("cant open dedupe file %v: %v", s.path, err)
+	}
+	s.lines = len(live)
+	return nil
+}
+
+//Close closes store file
+func (s *FileDedupeStore) Close() error {
+	s.mem.m.Lock()
+	defer s.mem.m.Unlock()
+	return s.file.Close()
+}
+
+var _ DedupeStore = (*MemoryDedupeStore)(nil)
+var _ DedupeStore = (*FileDedupeStore)(nil)
@@ -0,0 +1,155 @@
+package kafkaadapt
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+func seen(t *testing.T, s DedupeStore, topic, id string) bool {
+	t.Helper()
+	ok, err := s.Seen(topic, id)
+	if err != nil {
+		t.Fatalf("seen %v/%v: %v", topic, id, err)
+	}
+	return ok
+}
+
+func TestMemoryDedupeStoreLRU(t *testing.T) {
+	s := NewMemoryDedupeStore(2, 0)
+	s.Mark("orders", "1")
+	s.Mark("orders", "2")
+	//повторная отметка делает id самым свежим
+	s.Mark("orders", "1")
+	s.Mark("orders", "3")
+	if !seen(t, s, "orders", "1") || !seen(t, s, "orders", "3") {
+		t.Fatal("recently marked ids must be kept")
+	}
+	if seen(t, s, "orders", "2") {
+		t.Fatal("least recently marked id must be evicted")
+	}
+	if seen(t, s, "payments", "1") {
+		t.Fatal("ids of other topic must not be seen")
+	}
+}
+
+func TestMemoryDedupeStoreTTL(t *testing.T) {
+	s := NewMemoryDedupeStore(10, 50*time.Millisecond)
+	s.Mark("orders", "1")
+	if !seen(t, s, "orders", "1") {
+		t.Fatal("marked id must be seen before ttl")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if seen(t, s, "orders", "1") {
+		t.Fatal("id must be forgotten after ttl")
+	}
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		n++
+	}
+	return n
+}
+
+func TestFileDedupeStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedupe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dedupe.log")
+
+	s, err := NewFileDedupeStore(path, 10, 0)
+	if err != nil {
+		t.Fatalf("create store: %v", err)
+	}
+	for _, id := range []string{"1", "2", "1"} {
+		if err := s.Mark("orders", id); err != nil {
+			t.Fatalf("mark: %v", err)
+		}
+	}
+	//недописанная при падении строка пропускается
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"t":"orders","id":"3"`)
+	f.Close()
+	s.Close()
+
+	reopened, err := NewFileDedupeStore(path, 10, 0)
+	if err != nil {
+		t.Fatalf("reopen store: %v", err)
+	}
+	defer reopened.Close()
+	if !seen(t, reopened, "orders", "1") || !seen(t, reopened, "orders", "2") {
+		t.Fatal("marked ids must survive restart")
+	}
+	if seen(t, reopened, "orders", "3") {
+		t.Fatal("incomplete entry must be skipped")
+	}
+	if n := countLines(t, path); n != 2 {
+		t.Fatalf("file must be compacted on start to 2 lines, got %v", n)
+	}
+}
+
+func TestFileDedupeStoreCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedupe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dedupe.log")
+
+	s, err := NewFileDedupeStore(path, 10, 0)
+	if err != nil {
+		t.Fatalf("create store: %v", err)
+	}
+	defer s.Close()
+	for i := 0; i < 1002; i++ {
+		if err := s.Mark("orders", fmt.Sprint(i)); err != nil {
+			t.Fatalf("mark: %v", err)
+		}
+	}
+	if n := countLines(t, path); n > 20 {
+		t.Fatalf("file must be compacted, got %v lines", n)
+	}
+	if !seen(t, s, "orders", "1001") || seen(t, s, "orders", "0") {
+		t.Fatal("only last marked ids must be kept")
+	}
+}
+
+func TestDedupeID(t *testing.T) {
+	q := &Queue{cfg: KafkaCfg{DedupeHeader: "x-id"}}
+	msg := &kafka.Message{
+		Topic: "orders.retry.5s",
+		Key:   []byte("key"),
+		Headers: []Header{
+			{Key: "x-id", Value: []byte("42")},
+			{Key: HeaderOriginalTopic, Value: []byte("orders")},
+		},
+	}
+	topic, id, ok := q.dedupeID(msg)
+	if !ok || topic != "orders" || id != "42" {
+		t.Fatalf("got %v %v %v, want id 42 of original topic", topic, id, ok)
+	}
+	msg.Headers = nil
+	if _, _, ok := q.dedupeID(msg); ok {
+		t.Fatal("message without header must have no id")
+	}
+}
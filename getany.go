@@ -0,0 +1,104 @@
+package kafkaadapt
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+)
+
+//Messages returns channel of messages from read topic (or pattern) for use in select statements.
+//Channel is closed when topic reader is unregistered, but not when queue is closed,
+//so select on ctx too. Returns nil if there is no such topic.
+func (q *Queue) Messages(topic string) <-chan *Message {
+	q.m.RLock()
+	defer q.m.RUnlock()
+	return q.messages[topic]
+}
+
+//GetAnyWithCtx gets single message from any of given topics (or patterns).
+//If several topics have messages ready, topic is chosen randomly in proportion to KafkaCfg.TopicWeights.
+//Unregistered topics are skipped, ErrUnregistered is returned only when all topics are unregistered.
+func (q *Queue) GetAnyWithCtx(ctx context.Context, topics ...string) (*Message, error) {
+	select {
+	case <-q.closed:
+		return nil, ErrClosed
+	default:
+
+	}
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("no topics given")
+	}
+
+	chans := make([]<-chan *Message, 0, len(topics))
+	weights := make([]int, 0, len(topics))
+	q.m.RLock()
+	for _, topic := range topics {
+		mch, ok := q.messages[topic]
+		if !ok {
+			q.m.RUnlock()
+			return nil, fmt.Errorf("there is no such topic declared in config: %v", topic)
+		}
+		chans = append(chans, mch)
+		weights = append(weights, q.cfg.weight(topic))
+	}
+	q.m.RUnlock()
+
+	//сначала неблокирующе опрашиваем топики во взвешенно-случайном порядке,
+	//т.к. reflect.Select выбирает среди готовых каналов равновероятно
+	for _, i := range weightedOrder(weights) {
+		select {
+		case msg, ok := <-chans[i]:
+			if ok {
+				return msg, nil
+			}
+			chans[i] = nil
+		default:
+		}
+	}
+
+	cases := make([]reflect.SelectCase, 0, len(chans)+2)
+	cases = append(cases,
+		reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+		reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(q.closed)},
+	)
+	open := 0
+	for _, mch := range chans {
+		if mch != nil {
+			open++
+		}
+		//nil channel is never selected
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(mch)})
+	}
+	for open > 0 {
+		chosen, v, ok := reflect.Select(cases)
+		switch chosen {
+		case 0:
+			return nil, context.Canceled
+		case 1:
+			return nil, ErrClosed
+		}
+		if ok {
+			return v.Interface().(*Message), nil
+		}
+		cases[chosen].Chan = reflect.ValueOf((<-chan *Message)(nil))
+		open--
+	}
+	return nil, ErrUnregistered
+}
+
+//weightedOrder returns indexes of weights in random order, where index with bigger weight tends to go first
+func weightedOrder(weights []int) []int {
+	keys := make([]float64, len(weights))
+	order := make([]int, len(weights))
+	for i, w := range weights {
+		order[i] = i
+		keys[i] = math.Pow(rand.Float64(), 1/float64(w))
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return keys[order[a]] > keys[order[b]]
+	})
+	return order
+}
@@ -1,5 +1,10 @@
 package kafkaadapt
 
+import (
+	"context"
+	"time"
+)
+
 type Config interface {
 	GetString(name string) (string, error)
 	GetInt(name string) (int, error)
@@ -9,3 +14,32 @@ type Logger interface {
 	Errorf(format string, args ...interface{})
 	Infof(format string, args ...interface{})
 }
+
+//MessageQueue is the common contract of kafka-backed Queue (see Queue.AsMessageQueue)
+//and in-memory MemoryQueue, so services can be unit-tested without a live broker
+type MessageQueue interface {
+	Put(queue string, data []byte) error
+	PutWithCtx(ctx context.Context, queue string, data []byte) error
+	PutBatch(queue string, data ...[]byte) error
+	PutKVBatchWithCtx(ctx context.Context, queue string, kvs ...KV) error
+	Get(queue string) (QueueMessage, error)
+	GetWithCtx(ctx context.Context, queue string) (QueueMessage, error)
+	Close()
+}
+
+//QueueMessage is a single message, received from MessageQueue
+type QueueMessage interface {
+	Data() []byte
+	Offset() int64
+	Key() []byte
+	Topic() string
+	Partition() int
+	Time() time.Time
+	HighWaterMark() int64
+	ConsumerGroup() string
+	Headers() []Header
+	Header(name string) []byte
+	Ack() error
+	Nack() error
+	NackWithDelay(d time.Duration) error
+}
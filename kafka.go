@@ -7,6 +7,8 @@ import (
 	kafka "github.com/segmentio/kafka-go"
 	"github.com/segmentio/kafka-go/sasl/plain"
 	"github.com/segmentio/kafka-go/snappy"
+	"os"
+	"regexp"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -14,10 +16,15 @@ import (
 )
 
 var ErrClosed = fmt.Errorf("kafka adapter is closed")
+var ErrUnregistered = fmt.Errorf("topic reader is unregistered")
+
+//Deprecated: Nack is supported in async acking mode, ErrAsyncNack is not returned anymore
 var ErrAsyncNack = fmt.Errorf("nack is inapplicable in async message acking mode")
 
 const (
-	writerChanSize = 100
+	writerChanSize      = 100
+	readerChanSize      = 100
+	asyncCommitInterval = time.Second
 )
 
 func FromStruct(cfg KafkaCfg, logger Logger) (*Queue, error) {
@@ -115,6 +122,20 @@ type KafkaCfg struct {
 	//possible topic partition count!
 	Concurrency int
 
+	//concurrency by read topic name, overrides Concurrency for given topics
+	//can be changed at runtime by Queue.ScaleReaders
+	TopicConcurrency map[string]int
+
+	//message leases by read topic (or pattern) name:
+	//message, which is not acked/nacked during lease after it was returned by GetWithCtx, is nacked automatically,
+	//its late Ack/Nack returns ErrLeaseExpired. Lease can be prolonged by Message.ExtendLease.
+	//with Subscribe in OrderedByKey mode expired lease cancels handler ctx instead and message is retried in place
+	TopicLeases map[string]time.Duration
+
+	//weights of topics (or patterns) for Queue.GetAnyWithCtx, default weight is 1
+	//topic with weight 3 is chosen 3 times more often than topic with weight 1, when both have messages ready
+	TopicWeights map[string]int
+
 	//max batch size that will be delivered by single writer at once
 	//in sync mode writer waits for batch is full or batch timeout outcome
 	//default is 100
@@ -131,25 +152,90 @@ type KafkaCfg struct {
 	//
 	//if false(default): kafka reader locks until previous message acked/nacked
 	//
-	//if true: kafka reader can produce multiple messages,
-	//but there is no possibility to provide Nack mechanism,
-	//thats why msg.Nack() will return error
+	//if true: kafka reader can produce multiple messages, acked in any order.
+	//offsets are tracked per partition and only contiguous acked prefix is committed,
+	//nacked messages are redelivered and hold commits of their partition until acked
 	AsyncAck bool
 
 	QueueToReadNames     []string
 	QueueToWriteNames    []string
 	ResetOffsetForTopics []string
 
+	//regular expressions of topic names to read, each one must match the whole topic name
+	//matching topics are discovered every TopicDiscoveryInterval and read by ReaderRegister,
+	//their messages are returned by GetWithCtx with pattern as topic name
+	QueueToReadPatterns []string
+	//default is 1 minute
+	TopicDiscoveryInterval time.Duration
+
 	Brokers           []string
 	ControllerAddress string
 
 	ConsumerGroupID string
 
+	//keeps read positions when ConsumerGroupID is empty:
+	//one reader is assigned to each topic partition (partitions, added later, are not read),
+	//messages need Ack/Nack and acked offsets are saved into OffsetStore instead of consumer group commits.
+	//see NewMemoryOffsetStore and NewFileOffsetStore
+	OffsetStore OffsetStore
+
+	//called when partitions of read topic are assigned to this instance by new consumer group generation.
+	//with any of rebalance hooks consumer group is read by generations: one reader is created for each assigned partition,
+	//TopicConcurrency and ScaleReaders are not used then
+	OnPartitionsAssigned func(topic string, partitions []int)
+	//called when generation ends on rebalance or reader closing, after in-flight messages of its partitions
+	//are acked/nacked and committed (but not longer than 30s, ctx is done then).
+	//rebalance is eager, so all partitions are revoked and then assigned again.
+	//instance doesn't rejoin group until hook returns, so partitions aren't read by anybody else meanwhile
+	OnPartitionsRevoked func(ctx context.Context, topic string, partitions []int)
+
+	//enables dedupe of read messages: ids of acked messages are marked in DedupeStore
+	//(but not of nacked ones, acked after publishing to retry or dead-letter topic),
+	//messages with already marked ids are acked without delivery and counted in Queue.Stats.
+	//see NewMemoryDedupeStore and NewFileDedupeStore
+	DedupeStore DedupeStore
+	//header, which value is message id for DedupeStore, message key is used if empty.
+	//messages without id are not deduped
+	DedupeHeader string
+
+	//enables background lag monitor of QueueToReadNames topics, nil disables it
+	LagMonitor *LagMonitorConfig
+
+	//enables stall watchdog of read topics, nil disables it
+	Watchdog *WatchdogConfig
+
 	CompressionCodec   string
 	DefaultTopicConfig TopicConfig
 
 	AuthSASLConfig AuthSASLConfig
+
+	//dead-letter policies by read topic name
+	//message, nacked MaxDeliveries times, is published to DeadLetterTopic and acked
+	//copies are written synchronously even in Async mode, so original is acked only after its copy is delivered
+	DeadLetterPolicies map[string]DeadLetterPolicy
+
+	//retry policies by read topic name
+	//nacked message is published to the next retry topic and acked,
+	//after the last retry topic it goes to dead-letter topic (if DeadLetterPolicies has one for the topic)
+	RetryPolicies map[string]RetryPolicy
 }
+
+//concurrency returns count of readers for topic
+func (c KafkaCfg) concurrency(topic string) int {
+	if n, ok := c.TopicConcurrency[topic]; ok && n > 0 {
+		return n
+	}
+	return c.Concurrency
+}
+
+//weight returns weight of topic for GetAnyWithCtx
+func (c KafkaCfg) weight(topic string) int {
+	if w, ok := c.TopicWeights[topic]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
 type AuthSASLConfig struct {
 	User     string
 	Password string
@@ -166,17 +252,39 @@ func (c TopicConfig) WithSetting(name, value string) {
 type Queue struct {
 	cfg           KafkaCfg
 	logger        Logger
+	clientID      string
 	c             *kafka.Client
 	srm           sarama.Client
-	readers       map[string]chan *kafka.Reader
+	readers       map[string]*topicReaders
 	readerOffsets map[string]*int64
 	offsetLock    sync.RWMutex
 
-	messages map[string]chan *Message
-	writers  map[string]chan *kafka.Writer
-	closed   chan struct{}
+	messages     map[string]chan *Message
+	writers      map[string]chan *kafka.Writer
+	writerCounts map[string]int
+	//synchronous writers of dead-letter and retry topics in Async mode, guarded by m
+	routeWriters map[string]*kafka.Writer
+	closed       chan struct{}
+	//closed when queue starts closing, before closed
+	closing chan struct{}
+
+	deliveries   map[deliveryKey]int
+	deliveryLock sync.Mutex
+	retryTiers   map[string]retryTier
+	acks         *ackTracker
+	stats        *queueStats
+	//consumer group members by read topic, when rebalance hooks are set
+	members map[string]*groupMember
+	//paused topics, channel is closed on resume
+	paused map[string]chan struct{}
+	//topic patterns by their source
+	patterns map[string]*regexp.Regexp
+	//count of ordered subscriptions by read topic name
+	ordered map[string]int
 
 	m sync.RWMutex
+	//serializes runtime changes of readers: unregistering, scaling, seeking
+	adminLock sync.Mutex
 }
 
 func (q *Queue) init() error {
@@ -185,11 +293,23 @@ func (q *Queue) init() error {
 		q.cfg.Concurrency = 1
 	}
 
-	q.readers = make(map[string]chan *kafka.Reader)
+	q.clientID = fmt.Sprintf("kafka-adapter-%d-%d", os.Getpid(), time.Now().UnixNano())
+	q.readers = make(map[string]*topicReaders)
 	q.readerOffsets = make(map[string]*int64)
 	q.messages = make(map[string]chan *Message)
 	q.writers = make(map[string]chan *kafka.Writer)
+	q.writerCounts = make(map[string]int)
+	q.routeWriters = make(map[string]*kafka.Writer)
 	q.closed = make(chan struct{})
+	q.closing = make(chan struct{})
+	q.deliveries = make(map[deliveryKey]int)
+	q.retryTiers = make(map[string]retryTier)
+	q.acks = newAckTracker()
+	q.members = make(map[string]*groupMember)
+	q.stats = newQueueStats()
+	q.paused = make(map[string]chan struct{})
+	q.patterns = make(map[string]*regexp.Regexp)
+	q.ordered = make(map[string]int)
 
 	//some checkup
 	for _, b := range q.cfg.Brokers {
@@ -208,62 +328,309 @@ func (q *Queue) init() error {
 
 	//fill readers
 	for _, topic := range q.cfg.QueueToReadNames {
-		q.ReaderRegister(topic)
+		err := q.ReaderRegisterWithErr(topic)
+		if err != nil {
+			return err
+		}
 	}
 	//fill writers
 	for _, topic := range q.cfg.QueueToWriteNames {
 		q.WriterRegister(topic)
 	}
+	for _, policy := range q.cfg.DeadLetterPolicies {
+		q.WriterRegister(policy.DeadLetterTopic)
+	}
+	//fill patterns
+	for _, pattern := range q.cfg.QueueToReadPatterns {
+		err := q.PatternRegister(pattern)
+		if err != nil {
+			return err
+		}
+	}
+	go q.discoverTopics()
+	if q.cfg.LagMonitor != nil {
+		go q.monitorLag()
+	}
+	if q.cfg.Watchdog != nil {
+		go q.watch()
+	}
 	return nil
 }
 
+//ReaderRegister starts reading topic, error is logged, see ReaderRegisterWithErr
 func (q *Queue) ReaderRegister(topic string) {
+	err := q.ReaderRegisterWithErr(topic)
+	if err != nil {
+		q.logger.Errorf("cant register reader: %v", err)
+	}
+}
+
+//ReaderRegisterWithErr starts reading topic and its retry topics.
+//Topic is not registered, if its readers can't be created.
+func (q *Queue) ReaderRegisterWithErr(topic string) error {
 	q.m.Lock()
 	defer q.m.Unlock()
 	if _, ok := q.readers[topic]; ok {
-		return
+		return nil
 	}
 	if topic == "" {
-		return
+		return nil
+	}
+	msgChan := make(chan *Message)
+	err := q.registerReaders(topic, topic, msgChan)
+	if err != nil {
+		return err
+	}
+	q.messages[topic] = msgChan
+	return nil
+}
+
+//registerReaders creates readers for topic and its retry topics, delivering messages into channel of given name,
+//nothing is registered on error, must be called under q.m
+func (q *Queue) registerReaders(topic, name string, msgChan chan *Message) error {
+	readers, err := q.createReaders(topic)
+	if err != nil {
+		return err
+	}
+	tiers := make(map[string][]*kafka.Reader)
+	for _, tier := range q.retryTopics(topic) {
+		if _, ok := q.readers[tier]; ok {
+			continue
+		}
+		tiers[tier], err = q.createReaders(tier)
+		if err != nil {
+			closeReaders(q.logger, readers)
+			for _, rs := range tiers {
+				closeReaders(q.logger, rs)
+			}
+			return err
+		}
+	}
+
+	q.addReaders(topic, name, msgChan, readers)
+	//сообщения из retry-топиков отдаются через канал исходного топика
+	for i, tier := range q.retryTopics(topic) {
+		q.retryTiers[tier] = retryTier{origin: topic, index: i}
+		if _, ok := q.writers[tier]; !ok {
+			q.addWriter(tier)
+		}
+		if rs, ok := tiers[tier]; ok {
+			q.addReaders(tier, name, msgChan, rs)
+		}
+	}
+	return nil
+}
+
+//createReaders creates readers of topic: Concurrency group readers or reader per partition with OffsetStore.
+//with rebalance hooks there are no readers until consumer group assigns partitions to member, see groupMember
+func (q *Queue) createReaders(topic string) ([]*kafka.Reader, error) {
+	if q.rebalanceHooks() {
+		return nil, nil
+	}
+	if q.storesOffsets() {
+		readers, err := q.newPartitionReaders(topic)
+		if err != nil {
+			return nil, fmt.Errorf("cant create readers of %v: %v", topic, err)
+		}
+		return readers, nil
+	}
+	var readers []*kafka.Reader
+	for i := 0; i < q.cfg.concurrency(topic); i++ {
+		readers = append(readers, q.newReader(topic))
+	}
+	return readers, nil
+}
+
+func closeReaders(logger Logger, readers []*kafka.Reader) {
+	for _, r := range readers {
+		err := r.Close()
+		if err != nil {
+			logger.Errorf("err during reader closing: %v", err)
+		}
+	}
+}
+
+//topicReaders holds readers of single topic and channels, shared by their producers and messages
+type topicReaders struct {
+	topic string
+	//name of messages channel: topic itself, origin topic for retry topics or pattern for topics found by it
+	name string
+	rch  chan *kafka.Reader
+	//messages channel, shared by all topics with the same name
+	msgs chan *Message
+	//closed on ReaderUnregister or readers restart to stop producers
+	stop     chan struct{}
+	stopOnce sync.Once
+	//each signal stops one producer on readers scaling down
+	shrink chan struct{}
+	//count of created readers, guarded by Queue.m
+	count    int
+	offset   *int64
+	inflight *inflightCounter
+	//consumer group generation, which partitions are read, nil without rebalance hooks
+	gen *groupGeneration
+	//running producers, shared with restarted topic readers, so msgs isn't closed while one of them can send into it
+	producers *sync.WaitGroup
+}
+
+//addReaders starts producers of topic readers, which deliver messages into msgChan of given name, must be called under q.m
+func (q *Queue) addReaders(topic, name string, msgChan chan *Message, readers []*kafka.Reader) {
+	size := readerChanSize
+	if len(readers) > size {
+		size = len(readers)
 	}
 	q.offsetLock.Lock()
 	var offset int64
 	q.readerOffsets[topic] = &offset
 	q.offsetLock.Unlock()
-	ch := make(chan *kafka.Reader, q.cfg.Concurrency)
-	msgChan := make(chan *Message)
-	for i := 0; i < q.cfg.Concurrency; i++ {
-		cfg := kafka.ReaderConfig{
-			Brokers:  q.cfg.Brokers,
-			GroupID:  q.cfg.ConsumerGroupID,
-			Topic:    topic,
-			MinBytes: 10e1,
-			MaxBytes: 10e5,
-		}
-		if q.isSaslAuth() {
-			mechanism := plain.Mechanism{
-				Username: q.cfg.AuthSASLConfig.User,
-				Password: q.cfg.AuthSASLConfig.Password,
-			}
-			dialer := &kafka.Dialer{
-				Timeout:       10 * time.Second,
-				DualStack:     true,
-				SASLMechanism: mechanism,
-			}
-			cfg.Dialer = dialer
+	tr := &topicReaders{
+		topic:     topic,
+		name:      name,
+		rch:       make(chan *kafka.Reader, size),
+		msgs:      msgChan,
+		stop:      make(chan struct{}),
+		shrink:    make(chan struct{}),
+		offset:    &offset,
+		inflight:  newInflightCounter(),
+		producers: &sync.WaitGroup{},
+	}
+	for _, r := range readers {
+		tr.rch <- r
+		tr.count++
+		tr.producers.Add(1)
+		go q.produceMessages(tr)
+	}
+	q.readers[topic] = tr
+	//с хуками ребалансировки ридеры партиций создаются на каждое поколение консумергруппы
+	if q.rebalanceHooks() {
+		q.addMember(topic)
+	}
+}
+
+//ScaleReaders changes count of topic readers at runtime.
+//Removed readers are closed as soon as they are released by their messages.
+//Count can't exceed max(Concurrency, 100) as it is the capacity of readers channel.
+//Unavailable with OffsetStore, where topic has one reader per partition.
+func (q *Queue) ScaleReaders(topic string, n int) error {
+	if q.storesOffsets() {
+		return fmt.Errorf("cant scale readers of %v: readers are assigned to partitions by OffsetStore mode", topic)
+	}
+	if q.rebalanceHooks() {
+		return fmt.Errorf("cant scale readers of %v: readers are assigned to partitions by consumer group generations", topic)
+	}
+	q.adminLock.Lock()
+	defer q.adminLock.Unlock()
+	q.m.Lock()
+	defer q.m.Unlock()
+	tr, ok := q.readers[topic]
+	if !ok {
+		return fmt.Errorf("there is no such topic declared in config: %v", topic)
+	}
+	if n < 1 || n > cap(tr.rch) {
+		return fmt.Errorf("incorrect readers count %v for %v, must be from 1 to %v", n, topic, cap(tr.rch))
+	}
+	for ; tr.count < n; tr.count++ {
+		tr.rch <- q.newReader(topic)
+		tr.producers.Add(1)
+		go q.produceMessages(tr)
+	}
+	for ; tr.count > n; tr.count-- {
+		go q.removeReader(tr)
+	}
+	return nil
+}
+
+//removeReader closes one of topic readers, when it's released, and stops one producer
+func (q *Queue) removeReader(tr *topicReaders) {
+	select {
+	case r := <-tr.rch:
+		err := r.Close()
+		if err != nil {
+			q.logger.Errorf("err during reader closing: %v", err)
 		}
-		if q.cfg.AsyncAck {
-			cfg.CommitInterval = time.Second
+	case <-q.closed:
+		return
+	}
+	select {
+	case tr.shrink <- struct{}{}:
+	case <-tr.stop:
+	case <-q.closed:
+	}
+}
+
+//halt stops producers of topic readers
+func (tr *topicReaders) halt() {
+	tr.stopOnce.Do(func() { close(tr.stop) })
+}
+
+//restartReaders starts new producers for halted topic readers, reusing readers channel
+func (q *Queue) restartReaders(tr *topicReaders) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	ntr := &topicReaders{
+		topic:     tr.topic,
+		name:      tr.name,
+		rch:       tr.rch,
+		msgs:      tr.msgs,
+		stop:      make(chan struct{}),
+		shrink:    tr.shrink,
+		count:     tr.count,
+		offset:    tr.offset,
+		inflight:  tr.inflight,
+		producers: tr.producers,
+		gen:       tr.gen,
+	}
+	q.readers[tr.topic] = ntr
+	for i := 0; i < ntr.count; i++ {
+		ntr.producers.Add(1)
+		go q.produceMessages(ntr)
+	}
+}
+
+func (q *Queue) newReader(topic string) *kafka.Reader {
+	cfg := q.readerConfig(topic)
+	cfg.GroupID = q.cfg.ConsumerGroupID
+	if q.cfg.AsyncAck {
+		cfg.CommitInterval = asyncCommitInterval
+	}
+	r := kafka.NewReader(cfg)
+	if contains(topic, q.cfg.ResetOffsetForTopics) {
+		r.SetOffset(kafka.FirstOffset)
+	}
+	return r
+}
+
+//readerConfig returns config of topic reader without consumer group
+func (q *Queue) readerConfig(topic string) kafka.ReaderConfig {
+	cfg := kafka.ReaderConfig{
+		Brokers:  q.cfg.Brokers,
+		Topic:    topic,
+		MinBytes: 10e1,
+		MaxBytes: 10e5,
+	}
+	//client id отличает участников группы этого экземпляра от чужих
+	dialer := &kafka.Dialer{
+		Timeout:   10 * time.Second,
+		DualStack: true,
+		ClientID:  q.clientID,
+	}
+	if q.isSaslAuth() {
+		dialer.SASLMechanism = plain.Mechanism{
+			Username: q.cfg.AuthSASLConfig.User,
+			Password: q.cfg.AuthSASLConfig.Password,
 		}
-		r := kafka.NewReader(cfg)
-		if contains(topic, q.cfg.ResetOffsetForTopics) {
-			r.SetOffset(kafka.FirstOffset)
+	}
+	cfg.Dialer = dialer
+	return cfg
+}
+
+func lastHeader(headers []Header, name string) []byte {
+	for i := len(headers) - 1; i >= 0; i-- {
+		if headers[i].Key == name {
+			return headers[i].Value
 		}
-		ch <- r
-		go q.produceMessages(ch, msgChan)
 	}
-	q.readers[topic] = ch
-	q.messages[topic] = msgChan
+	return nil
 }
 
 func contains(s string, arr []string) bool {
@@ -281,9 +648,19 @@ func (q *Queue) WriterRegister(topic string) {
 	if topic == "" {
 		return
 	}
+	q.addWriter(topic)
+}
+
+//addWriter creates one more writer for topic, must be called under q.m
+func (q *Queue) addWriter(topic string) {
 	if _, ok := q.writers[topic]; !ok {
 		q.writers[topic] = make(chan *kafka.Writer, writerChanSize)
 	}
+	q.writerCounts[topic]++
+	q.writers[topic] <- q.newWriter(topic, q.cfg.Async)
+}
+
+func (q *Queue) newWriter(topic string, async bool) *kafka.Writer {
 	var codec kafka.CompressionCodec
 	switch q.cfg.CompressionCodec {
 	case "snappy":
@@ -295,7 +672,7 @@ func (q *Queue) WriterRegister(topic string) {
 		Brokers:          q.cfg.Brokers,
 		BatchSize:        q.cfg.BatchSize,
 		BatchTimeout:     time.Millisecond * 200,
-		Async:            q.cfg.Async,
+		Async:            async,
 		Topic:            topic,
 		Balancer:         &kafka.LeastBytes{},
 		CompressionCodec: codec,
@@ -310,7 +687,7 @@ func (q *Queue) WriterRegister(topic string) {
 		}
 		w.Transport = sharedTransport
 	}
-	q.writers[topic] <- w
+	return w
 }
 
 func (q *Queue) WritersRegister(topic string, concurrency int) {
@@ -319,6 +696,10 @@ func (q *Queue) WritersRegister(topic string, concurrency int) {
 	}
 }
 
+//CleanupOffsets commits zero offset of first partitions count of topic partitions, as it always did:
+//without any checks of consumer group members and without waiting for in-flight messages.
+//
+//Deprecated: use ResetOffsets, which finds partitions by metadata and keeps readers of this instance consistent
 func (q *Queue) CleanupOffsets(topic string, partitions int) error {
 	of, err := sarama.NewOffsetManagerFromClient(q.cfg.ConsumerGroupID, q.srm)
 	if err != nil {
@@ -337,7 +718,8 @@ func (q *Queue) CleanupOffsets(topic string, partitions int) error {
 	return nil
 }
 
-func (q *Queue) produceMessages(rch chan *kafka.Reader, ch chan *Message) {
+func (q *Queue) produceMessages(tr *topicReaders) {
+	defer tr.producers.Done()
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -345,13 +727,15 @@ func (q *Queue) produceMessages(rch chan *kafka.Reader, ch chan *Message) {
 		select {
 		case <-q.closed:
 			cancel()
+		case <-tr.stop:
+			cancel()
 		case <-ctx.Done():
 			return
 		}
 	}()
 
 	for {
-		ok := q.producerIteration(ctx, rch, ch)
+		ok := q.producerIteration(ctx, tr)
 		if !ok {
 			return
 		}
@@ -362,58 +746,93 @@ func (q *Queue) isSaslAuth() bool {
 	return q.cfg.AuthSASLConfig.User != "" && q.cfg.AuthSASLConfig.Password != ""
 }
 
-func (q *Queue) producerIteration(ctx context.Context, rch chan *kafka.Reader, ch chan *Message) bool {
+func (q *Queue) producerIteration(ctx context.Context, tr *topicReaders) bool {
 	select {
 	case <-q.closed:
 		return false
+	case <-ctx.Done():
+		return false
 	default:
 	}
 
+	if !q.waitResumed(ctx, tr.name) {
+		return false
+	}
+
 	var r *kafka.Reader
 	var ok bool
 	select {
-	case r, ok = <-rch:
+	case r, ok = <-tr.rch:
 		if !ok {
 			return false
 		}
+	case <-tr.shrink:
+		return false
 	case <-ctx.Done():
 		return false
 	}
 
 	msg, err := r.FetchMessage(ctx)
 	if err != nil {
-		q.logger.Errorf("error during kafka message fetching: %v", err)
-		rch <- r
+		if ctx.Err() == nil {
+			q.logger.Errorf("error during kafka message fetching: %v", err)
+		}
+		tr.rch <- r
 		return true
 	}
+	touch(&q.stats.topic(msg.Topic).lastFetched)
+	if !q.waitRetryDue(ctx, &msg) {
+		//ридеры остановленного топика закрываются или пересоздаются, так что незакоммиченное сообщение будет прочитано заново
+		tr.rch <- r
+		return false
+	}
 
 	// суть в том, что ридер вернется в канал ридеров только при ack/nack, не раньше.
 	// следующее сообщение с ридера читать нельзя, пока не будет ack/nack на предыдущем.
 	mi := Message{
+		q:       q,
 		msg:     &msg,
 		reader:  r,
-		rch:     rch,
-		needack: q.cfg.ConsumerGroupID != "",
+		tr:      tr,
+		held:    true,
+		needack: q.cfg.ConsumerGroupID != "" || q.storesOffsets(),
+		lease:   q.newLease(tr.name),
 		actualizeOffset: func(o int64) {
-			atomic.StoreInt64(q.readerOffsets[r.Config().Topic], o)
+			atomic.StoreInt64(tr.offset, o)
 		},
 	}
+	mi.add()
 	// если консумергруппа пуста, то месседжи подтверждаются автоматически и удерживать ридер нет смысла.
-	if q.cfg.ConsumerGroupID == "" {
-		mi.once.Do(mi.returnReader)
+	// если асинхронное подтверждение, то месседжи подтверждаются в произвольном порядке и удерживать ридер нет смысла,
+	// а оффсет коммитится только до первого неподтвержденного сообщения партиции.
+	// ридер возвращается только после отправки сообщения, чтобы следующее сообщение партиции его не обогнало.
+	free := !mi.needack || q.cfg.AsyncAck
+	if free {
+		mi.held = false
+		mi.async = q.cfg.AsyncAck && mi.needack
+		if mi.async {
+			q.acks.track(&msg)
+		}
 	}
-	// если асинхронное подтверждение, то месседжи подтверждаются в произвольном порядке и удерживать ридер нет смысла.
-	if q.cfg.AsyncAck && q.cfg.ConsumerGroupID != "" {
-		mi.once.Do(mi.returnReader)
+	if q.duplicate(&msg) {
+		err := mi.Ack()
+		if err != nil {
+			q.logger.Errorf("err during duplicate message ack: %v", err)
+		}
+		if free {
+			tr.rch <- r
+		}
+		return true
 	}
 	select {
-	case ch <- &mi:
-		break
+	case tr.msgs <- &mi:
+		touch(&q.stats.topic(msg.Topic).lastDelivered)
+		mi.startLease()
 	case <-ctx.Done():
-		err := r.Close()
-		if err != nil {
-			q.logger.Errorf("err during reader closing: %v", err)
-		}
+		mi.abandon()
+	}
+	if free {
+		tr.rch <- r
 	}
 	return true
 }
@@ -432,40 +851,39 @@ func (q *Queue) PutBatch(queue string, data ...[]byte) error {
 }
 
 func (q *Queue) PutBatchWithCtx(ctx context.Context, queue string, data ...[]byte) error {
-	select {
-	case <-q.closed:
-		return ErrClosed
-	default:
-
-	}
+	return q.PutBatchWithHeadersCtx(ctx, queue, nil, data...)
+}
 
+//PutBatchWithHeadersCtx puts given data into topic, attaching the same headers to each message
+func (q *Queue) PutBatchWithHeadersCtx(ctx context.Context, queue string, headers []Header, data ...[]byte) error {
 	msgs := make([]kafka.Message, 0)
 	for _, d := range data {
-		msgs = append(msgs, kafka.Message{Value: d})
-	}
-	q.m.RLock()
-	wch, ok := q.writers[queue]
-	q.m.RUnlock()
-	if ok {
-		w := <-wch
-		wch <- w
-		err := w.WriteMessages(ctx, msgs...)
-		if err != nil {
-			return fmt.Errorf("error during writing Message to kafka: %v", err)
-		}
-		return nil
+		msgs = append(msgs, kafka.Message{Value: d, Headers: headers})
 	}
-	return fmt.Errorf("there is no such topic declared in config: %v", queue)
+	return q.writeMessages(ctx, queue, msgs...)
 }
 
 // KV - пара ключ-значение, которые можно использовать в качестве данных сообщения kafka
 // ключ может быть пустым, но надо учитывать, что в топиках с компакцией по ключу, а не по дате, в таком случае
+// Headers - необязательные заголовки сообщения
 type KV struct {
-	Key   []byte
-	Value []byte
+	Key     []byte
+	Value   []byte
+	Headers []Header
 }
 
+//Header is kafka record header, for example trace id or content-type
+type Header = kafka.Header
+
 func (q *Queue) PutKVBatchWithCtx(ctx context.Context, queue string, kvs ...KV) error {
+	msgs := make([]kafka.Message, 0)
+	for _, kv := range kvs {
+		msgs = append(msgs, kafka.Message{Key: kv.Key, Value: kv.Value, Headers: kv.Headers})
+	}
+	return q.writeMessages(ctx, queue, msgs...)
+}
+
+func (q *Queue) writeMessages(ctx context.Context, queue string, msgs ...kafka.Message) error {
 	select {
 	case <-q.closed:
 		return ErrClosed
@@ -473,15 +891,16 @@ func (q *Queue) PutKVBatchWithCtx(ctx context.Context, queue string, kvs ...KV)
 
 	}
 
-	msgs := make([]kafka.Message, 0)
-	for _, kv := range kvs {
-		msgs = append(msgs, kafka.Message{Key: kv.Key, Value: kv.Value})
-	}
 	q.m.RLock()
 	wch, ok := q.writers[queue]
 	q.m.RUnlock()
 	if ok {
-		w := <-wch
+		var w *kafka.Writer
+		select {
+		case w = <-wch:
+		case <-ctx.Done():
+			return fmt.Errorf("error during writing Message to kafka: %v", ctx.Err())
+		}
 		wch <- w
 		err := w.WriteMessages(ctx, msgs...)
 		if err != nil {
@@ -489,6 +908,12 @@ func (q *Queue) PutKVBatchWithCtx(ctx context.Context, queue string, kvs ...KV)
 		}
 		return nil
 	}
+	select {
+	case <-q.closing:
+		//writers are already flushed by CloseWithCtx
+		return ErrClosed
+	default:
+	}
 	return fmt.Errorf("there is no such topic declared in config: %v", queue)
 }
 
@@ -517,12 +942,44 @@ func (q *Queue) GetWithCtx(ctx context.Context, queue string) (*Message, error)
 		return nil, context.Canceled
 	case <-q.closed:
 		return nil, ErrClosed
-	case msg := <-mch:
+	case msg, ok := <-mch:
+		if !ok {
+			return nil, ErrUnregistered
+		}
 		return msg, nil
 	}
 }
 
+//AsMessageQueue returns q as MessageQueue interface, which is also implemented by MemoryQueue
+func (q *Queue) AsMessageQueue() MessageQueue {
+	return kafkaMessageQueue{q}
+}
+
+//kafkaMessageQueue adapts Get methods of Queue, returning *Message, to MessageQueue
+type kafkaMessageQueue struct {
+	*Queue
+}
+
+func (k kafkaMessageQueue) Get(queue string) (QueueMessage, error) {
+	return k.GetWithCtx(context.Background(), queue)
+}
+
+func (k kafkaMessageQueue) GetWithCtx(ctx context.Context, queue string) (QueueMessage, error) {
+	msg, err := k.Queue.GetWithCtx(ctx, queue)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
 func (q *Queue) Close() {
+	q.m.Lock()
+	select {
+	case <-q.closing:
+	default:
+		close(q.closing)
+	}
+	q.m.Unlock()
 	select {
 	case <-q.closed:
 		return
@@ -533,11 +990,11 @@ func (q *Queue) Close() {
 	q.m.Lock()
 	defer q.m.Unlock()
 	q.srm.Close()
-	for _, rchan := range q.readers {
+	for _, tr := range q.readers {
 	readers:
 		for {
 			select {
-			case r := <-rchan:
+			case r := <-tr.rch:
 				wg.Add(1)
 				go func() {
 					err := r.Close()
@@ -552,8 +1009,15 @@ func (q *Queue) Close() {
 			}
 		}
 	}
+	for topic, w := range q.routeWriters {
+		err := w.Close()
+		if err != nil {
+			q.logger.Errorf("err during writer closing: %v", err)
+		}
+		delete(q.routeWriters, topic)
+	}
 	for _, wch := range q.writers {
-		go func() {
+		go func(wch chan *kafka.Writer) {
 			//оставляем это без waitgroup, т.к. в пакете kafka-go баг.
 			//если writemessages закрывается до того, как все результаты внутренних ретраев были считаны
 			//например, при закрытии контекста
@@ -567,7 +1031,7 @@ func (q *Queue) Close() {
 				}
 			}
 
-		}()
+		}(wch)
 	}
 	wg.Wait()
 }
@@ -631,6 +1095,8 @@ func (q *Queue) SetTopicConfig(topic string, entries map[string]*string) error {
 
 //Returns consumer lag for given topic, if topic previously was registered in adapter by RegisterReader
 //Returns error if context was closed or topic reader wasn't registered yet
+//
+//Deprecated: checks partition 0 only against offset of this instance, use GetConsumerLag
 func (q *Queue) GetConsumerLagForSinglePartition(ctx context.Context, topicName string) (int64, error) {
 	newest, err := q.srm.GetOffset(topicName, 0, sarama.OffsetNewest)
 	if err != nil {
@@ -660,12 +1126,15 @@ func (q *Queue) GetSaramaConfig() *sarama.Config {
 }
 
 type Message struct {
+	q               *Queue
 	msg             *kafka.Message
 	reader          *kafka.Reader
-	rch             chan *kafka.Reader
+	tr              *topicReaders
 	once            sync.Once
+	held            bool
 	async           bool
 	needack         bool
+	lease           *messageLease
 	actualizeOffset func(o int64)
 }
 
@@ -677,29 +1146,248 @@ func (k *Message) Offset() int64 {
 	return k.msg.Offset
 }
 
+func (k *Message) Key() []byte {
+	return k.msg.Key
+}
+
+func (k *Message) Topic() string {
+	return k.msg.Topic
+}
+
+func (k *Message) Partition() int {
+	return k.msg.Partition
+}
+
+//Time returns kafka record timestamp
+func (k *Message) Time() time.Time {
+	return k.msg.Time
+}
+
+//HighWaterMark returns offset of the next message in partition at the moment of fetching
+func (k *Message) HighWaterMark() int64 {
+	return k.msg.HighWaterMark
+}
+
+//ConsumerGroup returns consumer group, which delivered message, or empty string if group wasn't set
+func (k *Message) ConsumerGroup() string {
+	//ридеры поколений читают партиции без группы, коммитя оффсеты через поколение
+	if k.tr != nil && k.tr.gen != nil {
+		return k.q.cfg.ConsumerGroupID
+	}
+	return k.reader.Config().GroupID
+}
+
+//Headers returns all kafka record headers of message
+func (k *Message) Headers() []Header {
+	return k.msg.Headers
+}
+
+//Header returns value of the last header with given name, or nil if there is no such header
+func (k *Message) Header(name string) []byte {
+	return lastHeader(k.msg.Headers, name)
+}
+
 func (k *Message) returnReader() {
-	k.rch <- k.reader
+	if k.held {
+		k.tr.rch <- k.reader
+	}
 }
 
-func (k *Message) returnNewReader() {
-	k.rch <- kafka.NewReader(k.reader.Config())
-	k.reader.Close()
+//finish returns reader and marks message as not in-flight anymore
+func (k *Message) finish() {
+	k.returnReader()
+	k.done()
 }
 
-func (k *Message) Ack() error {
-	k.actualizeOffset(k.msg.Offset)
-	k.once.Do(k.returnReader)
+//add marks message as in-flight.
+//messages without consumer group are auto-acked and never acked by callers, so they are not counted.
+func (k *Message) add() {
+	if !k.needack {
+		return
+	}
+	k.tr.inflight.add()
+}
+
+//done marks message as not in-flight anymore
+func (k *Message) done() {
 	if !k.needack {
+		return
+	}
+	k.tr.inflight.done()
+}
+
+//redeliver sends message once more into topic messages channel after delay.
+//reader stays held by message (if it was), so next message from its partition is the same one.
+//in async ack mode message offset stays uncommitted until redelivered message is acked.
+func (k *Message) redeliver(delay time.Duration) {
+	next := &Message{
+		q:               k.q,
+		msg:             k.msg,
+		reader:          k.reader,
+		tr:              k.tr,
+		held:            k.held,
+		async:           k.async,
+		needack:         k.needack,
+		lease:           k.q.newLease(k.tr.name),
+		actualizeOffset: k.actualizeOffset,
+	}
+	go func() {
+		if delay > 0 {
+			t := time.NewTimer(delay)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-k.q.closed:
+				next.abandon()
+				return
+			case <-k.tr.stop:
+				next.abandon()
+				return
+			}
+		}
+		select {
+		case k.tr.msgs <- next:
+			touch(&k.q.stats.topic(k.msg.Topic).lastDelivered)
+			next.startLease()
+		case <-k.q.closed:
+			next.abandon()
+		case <-k.tr.stop:
+			next.abandon()
+		}
+	}()
+}
+
+//abandon drops undelivered message, its held reader is closed if queue is closed or returned otherwise
+func (k *Message) abandon() {
+	k.once.Do(func() {
+		k.done()
+		if !k.held {
+			return
+		}
+		select {
+		case <-k.q.closed:
+			k.closeReader()
+		default:
+			k.tr.rch <- k.reader
+		}
+	})
+}
+
+func (k *Message) closeReader() {
+	err := k.reader.Close()
+	if err != nil {
+		k.q.logger.Errorf("err during reader closing: %v", err)
+	}
+}
+
+//Ack commits message offset, returns ErrLeaseExpired if message was already nacked by lease expiration
+func (k *Message) Ack() error {
+	if !k.lease.claim() {
+		return ErrLeaseExpired
+	}
+	return k.ack()
+}
+
+func (k *Message) ack() error {
+	return k.commit(true)
+}
+
+//ackRouted commits offset of message, which copy was published to retry or dead-letter topic,
+//message isn't processed yet, so its id isn't marked in DedupeStore
+func (k *Message) ackRouted() error {
+	if !k.lease.claim() {
+		return ErrLeaseExpired
+	}
+	return k.commit(false)
+}
+
+func (k *Message) commit(processed bool) error {
+	commit, ok := k.settle(processed)
+	if !ok {
 		return nil
 	}
-	err := k.reader.CommitMessages(context.Background(), *k.msg)
+	err := k.q.commitMessages(context.Background(), k.tr, k.reader, commit)
 	return err
 }
 
-func (k *Message) Nack() error {
+//settle marks message as acked and returns message, which offset has to be committed
+func (k *Message) settle(processed bool) (kafka.Message, bool) {
+	k.actualizeOffset(k.msg.Offset)
+	k.q.forgetDeliveries(k.msg)
+	if processed {
+		k.q.markProcessed(k.msg)
+	}
+	touch(&k.q.stats.topic(k.msg.Topic).lastAcked)
+	k.once.Do(k.finish)
+	if !k.needack {
+		return kafka.Message{}, false
+	}
 	if k.async {
-		return ErrAsyncNack
+		//коммитим только непрерывно подтвержденный префикс оффсетов партиции
+		return k.q.acks.ack(k.msg)
+	}
+	return *k.msg, true
+}
+
+//detach returns held reader, so it can fetch next messages before this one is acked.
+//message offset is tracked as in async ack mode.
+func (k *Message) detach() {
+	if !k.held {
+		return
+	}
+	k.held = false
+	k.async = true
+	k.q.acks.track(k.msg)
+	k.tr.rch <- k.reader
+}
+
+//Nack redelivers message immediately, without reader re-creation
+func (k *Message) Nack() error {
+	return k.nack(nil, 0)
+}
+
+//NackWithError nacks message, reason is used as last error in dead-letter and retry headers
+func (k *Message) NackWithError(reason error) error {
+	return k.nack(reason, 0)
+}
+
+//NackWithDelay redelivers message after delay, without reader re-creation
+func (k *Message) NackWithDelay(d time.Duration) error {
+	return k.nack(nil, d)
+}
+
+//requeue redelivers message without nack routing
+func (k *Message) requeue() {
+	if !k.lease.claim() {
+		return
+	}
+	if !k.needack {
+		k.once.Do(k.finish)
+		return
+	}
+	k.once.Do(func() { k.redeliver(0) })
+}
+
+func (k *Message) nack(reason error, delay time.Duration) error {
+	if !k.lease.claim() {
+		return ErrLeaseExpired
+	}
+	return k.nackNow(reason, delay)
+}
+
+func (k *Message) nackNow(reason error, delay time.Duration) error {
+	// без консумергруппы сообщения подтверждены автоматически, повторно доставлять нечего.
+	if !k.needack {
+		k.once.Do(k.finish)
+		return nil
+	}
+	sent, err := k.q.reroute(k.msg, reason)
+	if err != nil {
+		k.q.logger.Errorf("err during nacked message routing: %v", err)
+	}
+	if sent {
+		return k.commit(false)
 	}
-	k.once.Do(k.returnNewReader)
+	k.once.Do(func() { k.redeliver(delay) })
 	return nil
 }
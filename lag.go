@@ -0,0 +1,129 @@
+package kafkaadapt
+
+import (
+	"context"
+	"fmt"
+
+	sarama "github.com/Shopify/sarama"
+)
+
+//ConsumerLag holds count of unread messages of topic by consumer group
+type ConsumerLag struct {
+	//lag by partition
+	Partitions map[int]int64
+	Total      int64
+}
+
+//GetConsumerLag returns lag of ConsumerGroupID (or offsets of OffsetStore without consumer group) on topic:
+//newest offset minus committed offset of every partition, found by metadata.
+//Committed offsets are read from broker, so topic doesn't have to be read by this instance.
+//Partition without committed offset is considered unread from its oldest offset.
+func (q *Queue) GetConsumerLag(ctx context.Context, topic string) (ConsumerLag, error) {
+	type result struct {
+		lag ConsumerLag
+		err error
+	}
+	//sarama не принимает контекст, поэтому ждем результата не дольше ctx
+	res := make(chan result, 1)
+	go func() {
+		lag, _, err := q.consumerLag(topic)
+		res <- result{lag: lag, err: err}
+	}()
+	select {
+	case r := <-res:
+		return r.lag, r.err
+	case <-ctx.Done():
+		return ConsumerLag{}, fmt.Errorf("cant get consumer lag of %v: %v", topic, ctx.Err())
+	}
+}
+
+//consumerLag returns lag of topic and sum of its committed offsets
+func (q *Queue) consumerLag(topic string) (ConsumerLag, int64, error) {
+	partitions, err := q.srm.Partitions(topic)
+	if err != nil {
+		return ConsumerLag{}, 0, fmt.Errorf("cant get partitions of %v: %v", topic, err)
+	}
+	committed, err := q.committedOffsets(topic, partitions)
+	if err != nil {
+		return ConsumerLag{}, 0, err
+	}
+	var consumed int64
+	lag := ConsumerLag{Partitions: make(map[int]int64, len(partitions))}
+	for _, p := range partitions {
+		newest, err := q.srm.GetOffset(topic, p, sarama.OffsetNewest)
+		if err != nil {
+			return ConsumerLag{}, 0, fmt.Errorf("cant get newest offset of %v[%v]: %v", topic, p, err)
+		}
+		offset, ok := committed[int(p)]
+		if !ok {
+			offset, err = q.srm.GetOffset(topic, p, sarama.OffsetOldest)
+			if err != nil {
+				return ConsumerLag{}, 0, fmt.Errorf("cant get oldest offset of %v[%v]: %v", topic, p, err)
+			}
+		}
+		consumed += offset
+		l := newest - offset
+		if l < 0 {
+			l = 0
+		}
+		lag.Partitions[int(p)] = l
+		lag.Total += l
+	}
+	return lag, consumed, nil
+}
+
+//committedOffsets returns committed offsets of topic partitions, partitions without committed offset are skipped
+func (q *Queue) committedOffsets(topic string, partitions []int32) (map[int]int64, error) {
+	res := make(map[int]int64)
+	if q.storesOffsets() {
+		for _, p := range partitions {
+			offset, ok, err := q.cfg.OffsetStore.Load(topic, int(p))
+			if err != nil {
+				return nil, fmt.Errorf("cant load offset of %v[%v]: %v", topic, p, err)
+			}
+			if ok {
+				res[int(p)] = offset
+			}
+		}
+		return res, nil
+	}
+	if q.cfg.ConsumerGroupID == "" {
+		return nil, fmt.Errorf("cant get committed offsets of %v: %v", topic, ErrNoConsumerGroup)
+	}
+	//вызывается часто монитором лага, поэтому запрашиваем координатор группы через общий клиент, без нового подключения
+	coordinator, err := q.srm.Coordinator(q.cfg.ConsumerGroupID)
+	if err != nil {
+		return nil, fmt.Errorf("cant get coordinator of consumer group %v: %v", q.cfg.ConsumerGroupID, err)
+	}
+	req := &sarama.OffsetFetchRequest{
+		Version:       1,
+		ConsumerGroup: q.cfg.ConsumerGroupID,
+	}
+	for _, p := range partitions {
+		req.AddPartition(topic, p)
+	}
+	committed, err := coordinator.FetchOffset(req)
+	if err != nil {
+		return nil, fmt.Errorf("cant get committed offsets of %v: %v", topic, err)
+	}
+	for _, p := range partitions {
+		b := committed.GetBlock(topic, p)
+		if b == nil {
+			continue
+		}
+		if b.Err == sarama.ErrNotCoordinatorForConsumer {
+			//координатор сменился, следующий запрос уйдет новому
+			err := q.srm.RefreshCoordinator(q.cfg.ConsumerGroupID)
+			if err != nil {
+				q.logger.Errorf("cant refresh coordinator of consumer group %v: %v", q.cfg.ConsumerGroupID, err)
+			}
+		}
+		if b.Err != sarama.ErrNoError {
+			return nil, fmt.Errorf("cant get committed offset of %v[%v]: %v", topic, p, b.Err)
+		}
+		if b.Offset >= 0 {
+			res[int(p)] = b.Offset
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,159 @@
+package kafkaadapt
+
+import (
+	"time"
+)
+
+const (
+	defaultLagMonitorInterval = time.Minute
+	defaultLagStuckChecks     = 3
+)
+
+type LagEventKind int
+
+const (
+	//lag reached threshold
+	LagThresholdExceeded LagEventKind = iota
+	//lag dropped below threshold after LagThresholdExceeded
+	LagRecovered
+	//lag grew during StuckChecks polls in a row, while committed offsets didn't move
+	LagGrowingWithoutProgress
+)
+
+func (k LagEventKind) String() string {
+	switch k {
+	case LagThresholdExceeded:
+		return "lag threshold exceeded"
+	case LagRecovered:
+		return "lag recovered"
+	case LagGrowingWithoutProgress:
+		return "lag grows without progress"
+	}
+	return "unknown lag event"
+}
+
+type LagEvent struct {
+	Kind  LagEventKind
+	Topic string
+	Lag   ConsumerLag
+	//threshold of topic, 0 if it isn't set
+	Threshold int64
+}
+
+//LagMonitorConfig enables background lag polling of QueueToReadNames topics, see KafkaCfg.LagMonitor
+type LagMonitorConfig struct {
+	//default is 1 minute
+	Interval time.Duration
+
+	//total lag, which is reported by LagThresholdExceeded, 0 disables threshold
+	Threshold int64
+	//thresholds by topic, override Threshold
+	TopicThresholds map[string]int64
+
+	//count of polls in a row with growing lag and not moving committed offsets, reported by LagGrowingWithoutProgress
+	//default is 3
+	StuckChecks int
+
+	//called on every lag event, events are logged by Logger if it's nil
+	OnEvent func(LagEvent)
+}
+
+func (c LagMonitorConfig) threshold(topic string) int64 {
+	if t, ok := c.TopicThresholds[topic]; ok {
+		return t
+	}
+	return c.Threshold
+}
+
+//topicLagState is state of topic lag between polls
+type topicLagState struct {
+	polled    bool
+	lag       int64
+	consumed  int64
+	exceeded  bool
+	growing   int
+	stuckSent bool
+}
+
+//monitorLag polls lag of read topics until queue is closing
+func (q *Queue) monitorLag() {
+	cfg := *q.cfg.LagMonitor
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultLagMonitorInterval
+	}
+	if cfg.StuckChecks < 1 {
+		cfg.StuckChecks = defaultLagStuckChecks
+	}
+	states := make(map[string]*topicLagState)
+	t := time.NewTicker(cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-q.closing:
+			return
+		case <-t.C:
+		}
+		for _, topic := range q.cfg.QueueToReadNames {
+			lag, consumed, err := q.consumerLag(topic)
+			if err != nil {
+				q.logger.Errorf("err during lag monitoring of %v: %v", topic, err)
+				continue
+			}
+			state, ok := states[topic]
+			if !ok {
+				state = &topicLagState{}
+				states[topic] = state
+			}
+			for _, e := range state.update(cfg, topic, lag, consumed) {
+				q.reportLag(cfg, e)
+			}
+		}
+	}
+}
+
+//update applies polled lag to state and returns events
+func (s *topicLagState) update(cfg LagMonitorConfig, topic string, lag ConsumerLag, consumed int64) []LagEvent {
+	var events []LagEvent
+	threshold := cfg.threshold(topic)
+	event := func(kind LagEventKind) {
+		events = append(events, LagEvent{Kind: kind, Topic: topic, Lag: lag, Threshold: threshold})
+	}
+	if threshold > 0 {
+		switch {
+		case lag.Total >= threshold && !s.exceeded:
+			s.exceeded = true
+			event(LagThresholdExceeded)
+		case lag.Total < threshold && s.exceeded:
+			s.exceeded = false
+			event(LagRecovered)
+		}
+	}
+
+	if s.polled && consumed == s.consumed && lag.Total > s.lag {
+		s.growing++
+	} else if !s.polled || consumed != s.consumed {
+		s.growing = 0
+		s.stuckSent = false
+	}
+	if s.growing >= cfg.StuckChecks && !s.stuckSent {
+		s.stuckSent = true
+		event(LagGrowingWithoutProgress)
+	}
+	s.polled = true
+	s.lag = lag.Total
+	s.consumed = consumed
+	return events
+}
+
+func (q *Queue) reportLag(cfg LagMonitorConfig, e LagEvent) {
+	if cfg.OnEvent != nil {
+		defer q.recoverHook("LagMonitorConfig.OnEvent")
+		cfg.OnEvent(e)
+		return
+	}
+	if e.Kind == LagRecovered {
+		q.logger.Infof("%v: %v, total lag %v", e.Topic, e.Kind, e.Lag.Total)
+		return
+	}
+	q.logger.Errorf("%v: %v, total lag %v, by partition %v", e.Topic, e.Kind, e.Lag.Total, e.Lag.Partitions)
+}
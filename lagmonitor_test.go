@@ -0,0 +1,99 @@
+package kafkaadapt
+
+import (
+	"testing"
+)
+
+func lagKinds(events []LagEvent) []LagEventKind {
+	var res []LagEventKind
+	for _, e := range events {
+		res = append(res, e.Kind)
+	}
+	return res
+}
+
+func TestTopicLagStateThreshold(t *testing.T) {
+	cfg := LagMonitorConfig{
+		Threshold:       100,
+		TopicThresholds: map[string]int64{"payments": 10},
+		StuckChecks:     3,
+	}
+	steps := []struct {
+		topic    string
+		lag      int64
+		consumed int64
+		want     []LagEventKind
+	}{
+		{"orders", 50, 1, nil},
+		{"orders", 100, 2, []LagEventKind{LagThresholdExceeded}},
+		//повторно о превышении не сообщается
+		{"orders", 150, 3, nil},
+		{"orders", 99, 4, []LagEventKind{LagRecovered}},
+		{"orders", 20, 5, nil},
+	}
+	s := &topicLagState{}
+	for i, step := range steps {
+		events := s.update(cfg, step.topic, ConsumerLag{Total: step.lag}, step.consumed)
+		if got := lagKinds(events); !equalKinds(got, step.want) {
+			t.Fatalf("step %v: got %v, want %v", i, got, step.want)
+		}
+		for _, e := range events {
+			if e.Threshold != 100 || e.Lag.Total != step.lag || e.Topic != "orders" {
+				t.Fatalf("step %v: unexpected event %+v", i, e)
+			}
+		}
+	}
+
+	s = &topicLagState{}
+	events := s.update(cfg, "payments", ConsumerLag{Total: 10}, 1)
+	if got := lagKinds(events); !equalKinds(got, []LagEventKind{LagThresholdExceeded}) {
+		t.Fatalf("topic threshold must override default one, got %v", got)
+	}
+}
+
+func TestTopicLagStateGrowingWithoutProgress(t *testing.T) {
+	cfg := LagMonitorConfig{StuckChecks: 2}
+	steps := []struct {
+		lag      int64
+		consumed int64
+		want     []LagEventKind
+	}{
+		{10, 5, nil},
+		{20, 5, nil},
+		{30, 5, []LagEventKind{LagGrowingWithoutProgress}},
+		//о зависании сообщается один раз, пока оффсеты не сдвинутся
+		{40, 5, nil},
+		{50, 6, nil},
+		{60, 6, nil},
+		{70, 6, []LagEventKind{LagGrowingWithoutProgress}},
+	}
+	s := &topicLagState{}
+	for i, step := range steps {
+		events := s.update(cfg, "orders", ConsumerLag{Total: step.lag}, step.consumed)
+		if got := lagKinds(events); !equalKinds(got, step.want) {
+			t.Fatalf("step %v: got %v, want %v", i, got, step.want)
+		}
+	}
+}
+
+func TestTopicLagStateNoThreshold(t *testing.T) {
+	s := &topicLagState{}
+	cfg := LagMonitorConfig{StuckChecks: 3}
+	for i := int64(0); i < 3; i++ {
+		if events := s.update(cfg, "orders", ConsumerLag{Total: 1000 * i}, i); len(events) != 0 {
+			t.Fatalf("no events expected without threshold and with progress, got %v", lagKinds(events))
+		}
+	}
+}
+
+func equalKinds(a, b []LagEventKind) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,153 @@
+package kafkaadapt
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//ErrLeaseExpired is returned by Ack/Nack of message, which lease is expired, message is already nacked then
+var ErrLeaseExpired = fmt.Errorf("message lease expired, message was nacked")
+
+//messageLease nacks message, which is not acked/nacked during lease
+type messageLease struct {
+	d     time.Duration
+	timer *time.Timer
+	//incremented on every timer restart, so expiration of stopped timer is ignored
+	gen     int
+	settled bool
+	expired bool
+	//cancels running handler of ordered subscription on expiration
+	cancel func()
+
+	m sync.Mutex
+}
+
+//newLease returns lease of message of read topic, nil if topic has no lease
+func (q *Queue) newLease(name string) *messageLease {
+	d, ok := q.cfg.TopicLeases[name]
+	if !ok || d <= 0 {
+		return nil
+	}
+	return &messageLease{d: d}
+}
+
+//startLease starts lease timer of handed out message
+func (k *Message) startLease() {
+	l := k.lease
+	if l == nil {
+		return
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.settled {
+		return
+	}
+	l.restart(k, l.d)
+}
+
+//restart starts lease timer anew, must be called under l.m
+func (l *messageLease) restart(k *Message, d time.Duration) {
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	l.gen++
+	gen := l.gen
+	l.timer = time.AfterFunc(d, func() { k.expire(gen) })
+}
+
+//claim settles lease before ack/nack, returns false if lease is expired
+func (l *messageLease) claim() bool {
+	if l == nil {
+		return true
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.expired {
+		return false
+	}
+	l.settled = true
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	return true
+}
+
+func (l *messageLease) isExpired() bool {
+	if l == nil {
+		return false
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.expired
+}
+
+//expire nacks message if lease of given timer generation is not settled or extended.
+//message of topic with ordered subscription is not nacked, as redelivery puts it behind later messages of its key,
+//its running handler is cancelled instead and retried in place.
+func (k *Message) expire(gen int) {
+	ordered := k.q.orderedSubscribed(k.tr.name)
+	l := k.lease
+	l.m.Lock()
+	if l.settled || l.gen != gen {
+		l.m.Unlock()
+		return
+	}
+	if ordered {
+		cancel := l.cancel
+		l.m.Unlock()
+		if cancel != nil {
+			k.q.logger.Errorf("lease of message from %v at offset %v expired, cancelling its handler", k.msg.Topic, k.msg.Offset)
+			cancel()
+		}
+		return
+	}
+	l.expired = true
+	l.m.Unlock()
+	k.q.logger.Errorf("lease of message from %v at offset %v expired, nacking it", k.msg.Topic, k.msg.Offset)
+	err := k.nackNow(ErrLeaseExpired, 0)
+	if err != nil {
+		k.q.logger.Errorf("err during expired message nack: %v", err)
+	}
+}
+
+//runLease restarts lease for new handler call of ordered subscription, which is cancelled by cancel on expiration
+func (k *Message) runLease(cancel func()) {
+	l := k.lease
+	if l == nil {
+		return
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.expired || l.settled {
+		return
+	}
+	l.cancel = cancel
+	l.restart(k, l.d)
+}
+
+//ExtendLease prolongs lease of message, so it expires in d from now.
+//Returns ErrLeaseExpired if lease is already expired, does nothing if topic has no lease (see KafkaCfg.TopicLeases).
+func (k *Message) ExtendLease(d time.Duration) error {
+	l := k.lease
+	if l == nil {
+		return nil
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.expired {
+		return ErrLeaseExpired
+	}
+	if l.settled {
+		return nil
+	}
+	l.restart(k, d)
+	return nil
+}
+
+//orderedSubscribed reports whether read topic is consumed by Subscribe in OrderedByKey mode
+func (q *Queue) orderedSubscribed(name string) bool {
+	q.m.RLock()
+	defer q.m.RUnlock()
+	return q.ordered[name] > 0
+}
@@ -0,0 +1,136 @@
+package kafkaadapt
+
+import (
+	"testing"
+	"time"
+)
+
+func newLeaseTestQueue(d time.Duration) *Queue {
+	return newTestQueue(KafkaCfg{TopicLeases: map[string]time.Duration{"orders": d}})
+}
+
+func TestNewLease(t *testing.T) {
+	q := newTestQueue(KafkaCfg{TopicLeases: map[string]time.Duration{"orders": time.Second, "payments": 0}})
+	if q.newLease("orders") == nil {
+		t.Fatal("topic with lease must have lease")
+	}
+	if q.newLease("payments") != nil || q.newLease("users") != nil {
+		t.Fatal("topic without positive lease must have no lease")
+	}
+
+	//сообщения без аренды подтверждаются как обычно
+	var l *messageLease
+	if !l.claim() || l.isExpired() {
+		t.Fatal("nil lease must be claimable and never expired")
+	}
+}
+
+func TestLeaseClaim(t *testing.T) {
+	q := newLeaseTestQueue(20 * time.Millisecond)
+	msg := newTestMessage(q, "orders", 0, 1, "k")
+
+	if !msg.lease.claim() {
+		t.Fatal("claim of active lease must succeed")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if msg.lease.isExpired() {
+		t.Fatal("settled lease must not expire")
+	}
+	if err := msg.ExtendLease(time.Second); err != nil {
+		t.Fatalf("extend lease after settle must do nothing, got %v", err)
+	}
+}
+
+func TestLeaseExpire(t *testing.T) {
+	q := newLeaseTestQueue(20 * time.Millisecond)
+	msg := newTestMessage(q, "orders", 0, 1, "k")
+
+	time.Sleep(50 * time.Millisecond)
+	if !msg.lease.isExpired() {
+		t.Fatal("lease must expire")
+	}
+	if err := msg.Ack(); err != ErrLeaseExpired {
+		t.Fatalf("ack after expiration must return ErrLeaseExpired, got %v", err)
+	}
+	if err := msg.Nack(); err != ErrLeaseExpired {
+		t.Fatalf("nack after expiration must return ErrLeaseExpired, got %v", err)
+	}
+	if err := msg.ExtendLease(time.Second); err != ErrLeaseExpired {
+		t.Fatalf("extend lease after expiration must return ErrLeaseExpired, got %v", err)
+	}
+}
+
+func TestExtendLease(t *testing.T) {
+	q := newLeaseTestQueue(30 * time.Millisecond)
+	msg := newTestMessage(q, "orders", 0, 1, "k")
+
+	if err := msg.ExtendLease(200 * time.Millisecond); err != nil {
+		t.Fatalf("extend lease: %v", err)
+	}
+	//таймер прежнего поколения остановлен и не должен истекать аренду
+	time.Sleep(80 * time.Millisecond)
+	if msg.lease.isExpired() {
+		t.Fatal("extended lease expired by timer of previous generation")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if !msg.lease.isExpired() {
+		t.Fatal("extended lease must expire after new duration")
+	}
+}
+
+func TestLeaseExpireOfStaleGeneration(t *testing.T) {
+	q := newLeaseTestQueue(time.Second)
+	msg := newTestMessage(q, "orders", 0, 1, "k")
+
+	msg.lease.m.Lock()
+	gen := msg.lease.gen
+	msg.lease.restart(msg, time.Second)
+	msg.lease.m.Unlock()
+	//срабатывание уже перезапущенного таймера игнорируется
+	msg.expire(gen)
+	if msg.lease.isExpired() {
+		t.Fatal("expiration of stale timer generation must be ignored")
+	}
+}
+
+func TestLeaseOrderedCancel(t *testing.T) {
+	q := newLeaseTestQueue(20 * time.Millisecond)
+	q.ordered["orders"] = 1
+	msg := newTestMessage(q, "orders", 0, 1, "k")
+
+	cancelled := make(chan struct{})
+	msg.runLease(func() { close(cancelled) })
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("expired lease of ordered message must cancel its handler")
+	}
+	if msg.lease.isExpired() {
+		t.Fatal("lease of ordered message must not be expired, message isn't nacked")
+	}
+
+	//следующий вызов обработчика получает аренду заново
+	msg.runLease(nil)
+	time.Sleep(50 * time.Millisecond)
+	if err := msg.Ack(); err != nil {
+		t.Fatalf("ack of ordered message after lease cancellation: %v", err)
+	}
+}
+
+func TestRunLeaseAfterSettle(t *testing.T) {
+	q := newLeaseTestQueue(20 * time.Millisecond)
+	q.ordered["orders"] = 1
+	msg := newTestMessage(q, "orders", 0, 1, "k")
+	if err := msg.Ack(); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+
+	called := make(chan struct{}, 1)
+	msg.runLease(func() { called <- struct{}{} })
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-called:
+		t.Fatal("lease of acked message must not be restarted")
+	default:
+	}
+}
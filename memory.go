@@ -0,0 +1,321 @@
+package kafkaadapt
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+var ErrNoConsumerGroup = fmt.Errorf("unavailable when GroupID is not set")
+
+//MemoryQueue is in-memory MessageQueue implementation, intended for unit tests.
+//It uses the same KafkaCfg as kafka-backed Queue, but only topic names, ConsumerGroupID,
+//Concurrency, TopicConcurrency and AsyncAck make sense for it, brokers are never dialed.
+//
+//Ack/Nack semantics are copied from Queue:
+//without ConsumerGroupID messages are auto-acked and Ack/Nack do nothing,
+//Nack redelivers message, in sync mode only Concurrency messages per topic can be unacked at once.
+type MemoryQueue struct {
+	cfg     KafkaCfg
+	topics  map[string]*memoryTopic
+	readers map[string]struct{}
+	writers map[string]struct{}
+	closed  chan struct{}
+
+	m sync.RWMutex
+}
+
+func NewMemoryQueue(cfg KafkaCfg) *MemoryQueue {
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	q := &MemoryQueue{
+		cfg:     cfg,
+		topics:  make(map[string]*memoryTopic),
+		readers: make(map[string]struct{}),
+		writers: make(map[string]struct{}),
+		closed:  make(chan struct{}),
+	}
+	for _, topic := range cfg.QueueToReadNames {
+		q.ReaderRegister(topic)
+	}
+	for _, topic := range cfg.QueueToWriteNames {
+		q.WriterRegister(topic)
+	}
+	return q
+}
+
+func (q *MemoryQueue) ReaderRegister(topic string) {
+	if topic == "" {
+		return
+	}
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.readers[topic] = struct{}{}
+}
+
+func (q *MemoryQueue) WriterRegister(topic string) {
+	if topic == "" {
+		return
+	}
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.writers[topic] = struct{}{}
+}
+
+//topic returns storage of given topic, creating it if needed
+func (q *MemoryQueue) topic(name string) *memoryTopic {
+	q.m.Lock()
+	defer q.m.Unlock()
+	t, ok := q.topics[name]
+	if !ok {
+		t = &memoryTopic{notify: make(chan struct{})}
+		q.topics[name] = t
+	}
+	return t
+}
+
+func (q *MemoryQueue) Put(queue string, data []byte) error {
+	return q.PutWithCtx(context.Background(), queue, data)
+}
+
+func (q *MemoryQueue) PutWithCtx(ctx context.Context, queue string, data []byte) error {
+	return q.PutBatchWithCtx(ctx, queue, data)
+}
+
+func (q *MemoryQueue) PutBatch(queue string, data ...[]byte) error {
+	return q.PutBatchWithCtx(context.Background(), queue, data...)
+}
+
+func (q *MemoryQueue) PutBatchWithCtx(ctx context.Context, queue string, data ...[]byte) error {
+	return q.PutBatchWithHeadersCtx(ctx, queue, nil, data...)
+}
+
+func (q *MemoryQueue) PutBatchWithHeadersCtx(ctx context.Context, queue string, headers []Header, data ...[]byte) error {
+	kvs := make([]KV, 0, len(data))
+	for _, d := range data {
+		kvs = append(kvs, KV{Value: d, Headers: headers})
+	}
+	return q.PutKVBatchWithCtx(ctx, queue, kvs...)
+}
+
+func (q *MemoryQueue) PutKVBatchWithCtx(ctx context.Context, queue string, kvs ...KV) error {
+	select {
+	case <-q.closed:
+		return ErrClosed
+	case <-ctx.Done():
+		return fmt.Errorf("error during writing Message to memory queue: %v", ctx.Err())
+	default:
+
+	}
+
+	q.m.RLock()
+	_, ok := q.writers[queue]
+	q.m.RUnlock()
+	if !ok {
+		return fmt.Errorf("there is no such topic declared in config: %v", queue)
+	}
+
+	t := q.topic(queue)
+	t.m.Lock()
+	defer t.m.Unlock()
+	for _, kv := range kvs {
+		t.pending = append(t.pending, &kafka.Message{
+			Topic:   queue,
+			Offset:  t.offset,
+			Time:    time.Now(),
+			Key:     kv.Key,
+			Value:   kv.Value,
+			Headers: kv.Headers,
+		})
+		t.offset++
+	}
+	for _, msg := range t.pending {
+		msg.HighWaterMark = t.offset
+	}
+	t.broadcast()
+	return nil
+}
+
+func (q *MemoryQueue) Get(queue string) (QueueMessage, error) {
+	return q.GetWithCtx(context.Background(), queue)
+}
+
+func (q *MemoryQueue) GetWithCtx(ctx context.Context, queue string) (QueueMessage, error) {
+	select {
+	case <-q.closed:
+		return nil, ErrClosed
+	default:
+
+	}
+
+	q.m.RLock()
+	_, ok := q.readers[queue]
+	q.m.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("there is no such topic declared in config: %v", queue)
+	}
+
+	needack := q.cfg.ConsumerGroupID != ""
+	// как и в kafka-режиме, в синхронном режиме неподтвержденными могут быть только Concurrency сообщений.
+	hold := needack && !q.cfg.AsyncAck
+	t := q.topic(queue)
+	for {
+		t.m.Lock()
+		if len(t.pending) > 0 && (!hold || t.inflight < q.cfg.concurrency(queue)) {
+			msg := t.pending[0]
+			t.pending = t.pending[1:]
+			if hold {
+				t.inflight++
+			}
+			t.m.Unlock()
+			return &memoryMessage{
+				msg:     msg,
+				topic:   t,
+				group:   q.cfg.ConsumerGroupID,
+				needack: needack,
+				hold:    hold,
+				closed:  q.closed,
+			}, nil
+		}
+		wait := t.notify
+		t.m.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, context.Canceled
+		case <-q.closed:
+			return nil, ErrClosed
+		case <-wait:
+		}
+	}
+}
+
+func (q *MemoryQueue) Close() {
+	q.m.Lock()
+	defer q.m.Unlock()
+	select {
+	case <-q.closed:
+	default:
+		close(q.closed)
+	}
+}
+
+type memoryTopic struct {
+	pending  []*kafka.Message
+	offset   int64
+	inflight int
+	//closed and recreated on every change of pending/inflight
+	notify chan struct{}
+
+	m sync.Mutex
+}
+
+//broadcast wakes up all waiting readers, must be called under t.m
+func (t *memoryTopic) broadcast() {
+	close(t.notify)
+	t.notify = make(chan struct{})
+}
+
+type memoryMessage struct {
+	msg     *kafka.Message
+	topic   *memoryTopic
+	once    sync.Once
+	group   string
+	needack bool
+	hold    bool
+	closed  chan struct{}
+}
+
+func (k *memoryMessage) Data() []byte {
+	return k.msg.Value
+}
+
+func (k *memoryMessage) Offset() int64 {
+	return k.msg.Offset
+}
+
+func (k *memoryMessage) Key() []byte {
+	return k.msg.Key
+}
+
+func (k *memoryMessage) Topic() string {
+	return k.msg.Topic
+}
+
+func (k *memoryMessage) Partition() int {
+	return k.msg.Partition
+}
+
+func (k *memoryMessage) Time() time.Time {
+	return k.msg.Time
+}
+
+func (k *memoryMessage) HighWaterMark() int64 {
+	return k.msg.HighWaterMark
+}
+
+func (k *memoryMessage) ConsumerGroup() string {
+	return k.group
+}
+
+func (k *memoryMessage) Headers() []Header {
+	return k.msg.Headers
+}
+
+func (k *memoryMessage) Header(name string) []byte {
+	return lastHeader(k.msg.Headers, name)
+}
+
+func (k *memoryMessage) release(requeue bool, delay time.Duration) {
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-k.closed:
+			return
+		}
+	}
+	k.topic.m.Lock()
+	defer k.topic.m.Unlock()
+	if requeue {
+		k.topic.pending = append([]*kafka.Message{k.msg}, k.topic.pending...)
+	}
+	if k.hold {
+		k.topic.inflight--
+	}
+	k.topic.broadcast()
+}
+
+func (k *memoryMessage) Ack() error {
+	//как и в kafka-режиме, без консумергруппы сообщения уже подтверждены
+	if !k.needack {
+		return nil
+	}
+	k.once.Do(func() { k.release(false, 0) })
+	return nil
+}
+
+func (k *memoryMessage) Nack() error {
+	//как и в kafka-режиме, без консумергруппы сообщения уже подтверждены
+	if !k.needack {
+		return nil
+	}
+	k.once.Do(func() { k.release(true, 0) })
+	return nil
+}
+
+func (k *memoryMessage) NackWithDelay(d time.Duration) error {
+	//как и в kafka-режиме, без консумергруппы сообщения уже подтверждены
+	if !k.needack {
+		return nil
+	}
+	k.once.Do(func() { go k.release(true, d) })
+	return nil
+}
+
+var _ MessageQueue = (*MemoryQueue)(nil)
@@ -0,0 +1,233 @@
+package kafkaadapt
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestMemoryQueue(group string, concurrency int) *MemoryQueue {
+	return NewMemoryQueue(KafkaCfg{
+		Concurrency:       concurrency,
+		ConsumerGroupID:   group,
+		QueueToReadNames:  []string{"orders"},
+		QueueToWriteNames: []string{"orders"},
+	})
+}
+
+func getWithTimeout(t *testing.T, q *MemoryQueue, topic string) (QueueMessage, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	return q.GetWithCtx(ctx, topic)
+}
+
+func TestMemoryQueuePutGet(t *testing.T) {
+	q := newTestMemoryQueue("group", 1)
+	defer q.Close()
+
+	err := q.PutKVBatchWithCtx(context.Background(), "orders",
+		KV{Key: []byte("k1"), Value: []byte("v1"), Headers: []Header{{Key: "trace", Value: []byte("t1")}}},
+		KV{Key: []byte("k2"), Value: []byte("v2")},
+	)
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	msg, err := getWithTimeout(t, q, "orders")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if string(msg.Data()) != "v1" || string(msg.Key()) != "k1" || msg.Offset() != 0 {
+		t.Fatalf("unexpected message: %q %q %v", msg.Key(), msg.Data(), msg.Offset())
+	}
+	if msg.Topic() != "orders" || msg.ConsumerGroup() != "group" || msg.HighWaterMark() != 2 {
+		t.Fatalf("unexpected metadata: %v %v %v", msg.Topic(), msg.ConsumerGroup(), msg.HighWaterMark())
+	}
+	if string(msg.Header("trace")) != "t1" {
+		t.Fatalf("unexpected header: %q", msg.Header("trace"))
+	}
+	if err := msg.Ack(); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+
+	msg, err = getWithTimeout(t, q, "orders")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if string(msg.Data()) != "v2" || msg.Offset() != 1 {
+		t.Fatalf("unexpected message: %q %v", msg.Data(), msg.Offset())
+	}
+}
+
+func TestMemoryQueueUnknownTopic(t *testing.T) {
+	q := newTestMemoryQueue("group", 1)
+	defer q.Close()
+
+	if err := q.Put("unknown", []byte("v")); err == nil {
+		t.Fatal("put to unknown topic must fail")
+	}
+	if _, err := q.Get("unknown"); err == nil {
+		t.Fatal("get from unknown topic must fail")
+	}
+}
+
+func TestMemoryQueueNackRedelivers(t *testing.T) {
+	q := newTestMemoryQueue("group", 1)
+	defer q.Close()
+
+	if err := q.PutBatch("orders", []byte("v1"), []byte("v2")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	msg, err := getWithTimeout(t, q, "orders")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if err := msg.Nack(); err != nil {
+		t.Fatalf("nack: %v", err)
+	}
+	msg, err = getWithTimeout(t, q, "orders")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if string(msg.Data()) != "v1" {
+		t.Fatalf("nacked message must be redelivered first, got %q", msg.Data())
+	}
+}
+
+func TestMemoryQueueNackWithDelay(t *testing.T) {
+	q := newTestMemoryQueue("group", 1)
+	defer q.Close()
+
+	if err := q.Put("orders", []byte("v1")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	msg, err := getWithTimeout(t, q, "orders")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	start := time.Now()
+	if err := msg.NackWithDelay(50 * time.Millisecond); err != nil {
+		t.Fatalf("nack: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	msg, err = q.GetWithCtx(ctx, "orders")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("message redelivered after %v, before delay", d)
+	}
+}
+
+func TestMemoryQueueSyncInflightLimit(t *testing.T) {
+	q := newTestMemoryQueue("group", 1)
+	defer q.Close()
+
+	if err := q.PutBatch("orders", []byte("v1"), []byte("v2")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	msg, err := getWithTimeout(t, q, "orders")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if _, err := getWithTimeout(t, q, "orders"); err == nil {
+		t.Fatal("second message must wait for ack of the first one in sync mode")
+	}
+	if err := msg.Ack(); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	if _, err := getWithTimeout(t, q, "orders"); err != nil {
+		t.Fatalf("get after ack: %v", err)
+	}
+}
+
+func TestMemoryQueueAsyncAck(t *testing.T) {
+	q := NewMemoryQueue(KafkaCfg{
+		ConsumerGroupID:   "group",
+		AsyncAck:          true,
+		QueueToReadNames:  []string{"orders"},
+		QueueToWriteNames: []string{"orders"},
+	})
+	defer q.Close()
+
+	if err := q.PutBatch("orders", []byte("v1"), []byte("v2")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := getWithTimeout(t, q, "orders"); err != nil {
+			t.Fatalf("get %v: %v", i, err)
+		}
+	}
+}
+
+func TestMemoryQueueWithoutGroup(t *testing.T) {
+	q := newTestMemoryQueue("", 1)
+	defer q.Close()
+
+	if err := q.PutBatch("orders", []byte("v1"), []byte("v2")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	msg, err := getWithTimeout(t, q, "orders")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	//как и в kafka-режиме, Ack/Nack без консумергруппы ничего не делают
+	if err := msg.Ack(); err != nil {
+		t.Fatalf("ack must do nothing, got %v", err)
+	}
+	if err := msg.Nack(); err != nil {
+		t.Fatalf("nack must do nothing, got %v", err)
+	}
+	//сообщения без консумергруппы подтверждены автоматически и не удерживают очередь
+	if _, err := getWithTimeout(t, q, "orders"); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+}
+
+func TestMemoryQueueClose(t *testing.T) {
+	q := newTestMemoryQueue("group", 1)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := q.Get("orders")
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.Close()
+	select {
+	case err := <-done:
+		if err != ErrClosed {
+			t.Fatalf("blocked get must return ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked get is not released by Close")
+	}
+	if err := q.Put("orders", []byte("v")); err != ErrClosed {
+		t.Fatalf("put after close must return ErrClosed, got %v", err)
+	}
+}
+
+func TestMemoryQueueCloseStopsDelayedNack(t *testing.T) {
+	q := newTestMemoryQueue("group", 1)
+
+	if err := q.Put("orders", []byte("v1")); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	msg, err := getWithTimeout(t, q, "orders")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if err := msg.NackWithDelay(50 * time.Millisecond); err != nil {
+		t.Fatalf("nack: %v", err)
+	}
+	q.Close()
+	time.Sleep(100 * time.Millisecond)
+	topic := q.topic("orders")
+	topic.m.Lock()
+	defer topic.m.Unlock()
+	if len(topic.pending) != 0 {
+		t.Fatal("delayed nack must not requeue message after Close")
+	}
+}
@@ -0,0 +1,200 @@
+package kafkaadapt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+//OffsetStore keeps read positions of group-less readers, see KafkaCfg.OffsetStore.
+//Offset is the offset of the next message to read, as in kafka commits.
+type OffsetStore interface {
+	//Load returns saved offset of partition, ok is false if nothing was saved yet
+	Load(topic string, partition int) (offset int64, ok bool, err error)
+	Save(topic string, partition int, offset int64) error
+}
+
+//storesOffsets reports that readers are assigned to partitions directly and keep offsets in OffsetStore
+func (q *Queue) storesOffsets() bool {
+	return q.cfg.ConsumerGroupID == "" && q.cfg.OffsetStore != nil
+}
+
+//commitMessages commits offsets of msgs through consumer group reader r (or generation of topic readers)
+//or saves them into OffsetStore
+func (q *Queue) commitMessages(ctx context.Context, tr *topicReaders, r *kafka.Reader, msgs ...kafka.Message) error {
+	if tr.gen != nil {
+		return tr.gen.commit(msgs...)
+	}
+	if !q.storesOffsets() {
+		return r.CommitMessages(ctx, msgs...)
+	}
+	for _, msg := range msgs {
+		//как и в коммитах kafka, сохраняется оффсет следующего сообщения
+		err := q.cfg.OffsetStore.Save(msg.Topic, msg.Partition, msg.Offset+1)
+		if err != nil {
+			return fmt.Errorf("cant save offset of %v[%v]: %v", msg.Topic, msg.Partition, err)
+		}
+	}
+	return nil
+}
+
+//newPartitionReaders creates reader for each topic partition, starting from offsets saved in OffsetStore
+func (q *Queue) newPartitionReaders(topic string) ([]*kafka.Reader, error) {
+	partitions, err := q.srm.Partitions(topic)
+	if err != nil {
+		return nil, fmt.Errorf("cant get partitions of %v: %v", topic, err)
+	}
+	if len(partitions) == 0 {
+		return nil, fmt.Errorf("topic %v has no partitions", topic)
+	}
+	readers := make([]*kafka.Reader, 0, len(partitions))
+	for _, p := range partitions {
+		readers = append(readers, q.newPartitionReader(topic, int(p)))
+	}
+	return readers, nil
+}
+
+func (q *Queue) newPartitionReader(topic string, partition int) *kafka.Reader {
+	offset, ok, err := q.cfg.OffsetStore.Load(topic, partition)
+	if err != nil {
+		q.logger.Errorf("cant load offset of %v[%v], reading from the first offset: %v", topic, partition, err)
+	}
+	if !ok || err != nil {
+		offset = kafka.FirstOffset
+	}
+	return q.partitionReader(topic, partition, offset)
+}
+
+//partitionReader creates group-less reader of partition, starting from offset
+func (q *Queue) partitionReader(topic string, partition int, offset int64) *kafka.Reader {
+	cfg := q.readerConfig(topic)
+	cfg.Partition = partition
+	r := kafka.NewReader(cfg)
+	err := r.SetOffset(offset)
+	if err != nil {
+		q.logger.Errorf("cant set offset of %v[%v]: %v", topic, partition, err)
+	}
+	return r
+}
+
+//recreateReader closes reader r of tr and returns new reader of the same topic (and partition for group-less readers)
+func (q *Queue) recreateReader(tr *topicReaders, r *kafka.Reader) *kafka.Reader {
+	cfg := r.Config()
+	err := r.Close()
+	if err != nil {
+		q.logger.Errorf("err during reader closing: %v", err)
+	}
+	if tr.gen != nil {
+		//ридер партиции поколения продолжает с последнего закоммиченного оффсета
+		nr := q.partitionReader(cfg.Topic, cfg.Partition, tr.gen.offset(cfg.Partition))
+		tr.gen.replace(r, nr)
+		return nr
+	}
+	if q.storesOffsets() {
+		return q.newPartitionReader(cfg.Topic, cfg.Partition)
+	}
+	return q.newReader(cfg.Topic)
+}
+
+//MemoryOffsetStore keeps offsets in memory, so they are lost on restart
+type MemoryOffsetStore struct {
+	offsets map[string]map[int]int64
+	m       sync.Mutex
+}
+
+func NewMemoryOffsetStore() *MemoryOffsetStore {
+	return &MemoryOffsetStore{
+		offsets: make(map[string]map[int]int64),
+	}
+}
+
+func (s *MemoryOffsetStore) Load(topic string, partition int) (int64, bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	offset, ok := s.offsets[topic][partition]
+	return offset, ok, nil
+}
+
+func (s *MemoryOffsetStore) Save(topic string, partition int, offset int64) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, ok := s.offsets[topic]; !ok {
+		s.offsets[topic] = make(map[int]int64)
+	}
+	s.offsets[topic][partition] = offset
+	return nil
+}
+
+//FileOffsetStore keeps offsets in json file, which is rewritten on every Save
+type FileOffsetStore struct {
+	path string
+	mem  *MemoryOffsetStore
+}
+
+//NewFileOffsetStore loads offsets from file at path, missing file is treated as empty
+func NewFileOffsetStore(path string) (*FileOffsetStore, error) {
+	s := &FileOffsetStore{
+		path: path,
+		mem:  NewMemoryOffsetStore(),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cant read offsets file %v: %v", path, err)
+	}
+	err = json.Unmarshal(data, &s.mem.offsets)
+	if err != nil {
+		return nil, fmt.Errorf("cant parse offsets file %v: %v", path, err)
+	}
+	if s.mem.offsets == nil {
+		s.mem.offsets = make(map[string]map[int]int64)
+	}
+	return s, nil
+}
+
+func (s *FileOffsetStore) Load(topic string, partition int) (int64, bool, error) {
+	return s.mem.Load(topic, partition)
+}
+
+func (s *FileOffsetStore) Save(topic string, partition int, offset int64) error {
+	s.mem.m.Lock()
+	defer s.mem.m.Unlock()
+	if _, ok := s.mem.offsets[topic]; !ok {
+		s.mem.offsets[topic] = make(map[int]int64)
+	}
+	s.mem.offsets[topic][partition] = offset
+	data, err := json.Marshal(s.mem.offsets)
+	if err != nil {
+		return fmt.Errorf("cant marshal offsets: %v", err)
+	}
+	//пишем во временный файл и переименовываем, чтобы не оставить файл недописанным при падении
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("cant create offsets file: %v", err)
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cant write offsets file: %v", err)
+	}
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cant write offsets file %v: %v", s.path, err)
+	}
+	return nil
+}
+
+var _ OffsetStore = (*MemoryOffsetStore)(nil)
+var _ OffsetStore = (*FileOffsetStore)(nil)
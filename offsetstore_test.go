@@ -0,0 +1,86 @@
+package kafkaadapt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testOffsetStore(t *testing.T, s OffsetStore) {
+	t.Helper()
+	if _, ok, err := s.Load("orders", 0); err != nil || ok {
+		t.Fatalf("empty store must have no offset, got %v %v", ok, err)
+	}
+	if err := s.Save("orders", 0, 10); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if err := s.Save("orders", 1, 20); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if err := s.Save("orders", 0, 11); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if offset, ok, err := s.Load("orders", 0); err != nil || !ok || offset != 11 {
+		t.Fatalf("load orders[0] = %v %v %v, want 11", offset, ok, err)
+	}
+	if offset, ok, err := s.Load("orders", 1); err != nil || !ok || offset != 20 {
+		t.Fatalf("load orders[1] = %v %v %v, want 20", offset, ok, err)
+	}
+	if _, ok, _ := s.Load("payments", 0); ok {
+		t.Fatal("offset of other topic must be missing")
+	}
+}
+
+func TestMemoryOffsetStore(t *testing.T) {
+	testOffsetStore(t, NewMemoryOffsetStore())
+}
+
+func TestFileOffsetStoreRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "offsets.json")
+
+	s, err := NewFileOffsetStore(path)
+	if err != nil {
+		t.Fatalf("create store: %v", err)
+	}
+	testOffsetStore(t, s)
+
+	reopened, err := NewFileOffsetStore(path)
+	if err != nil {
+		t.Fatalf("reopen store: %v", err)
+	}
+	if offset, ok, err := reopened.Load("orders", 0); err != nil || !ok || offset != 11 {
+		t.Fatalf("reopened load orders[0] = %v %v %v, want 11", offset, ok, err)
+	}
+	if offset, ok, err := reopened.Load("orders", 1); err != nil || !ok || offset != 20 {
+		t.Fatalf("reopened load orders[1] = %v %v %v, want 20", offset, ok, err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("temporary files must be removed, got %v files", len(files))
+	}
+}
+
+func TestFileOffsetStoreCorrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "offsets.json")
+	if err := ioutil.WriteFile(path, []byte("{broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileOffsetStore(path); err == nil {
+		t.Fatal("corrupted file must be reported")
+	}
+}
@@ -0,0 +1,90 @@
+package kafkaadapt
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+const defaultTopicDiscoveryInterval = time.Minute
+
+//PatternRegister starts reading all topics, which names fully match regular expression pattern.
+//Messages of these topics are returned by GetWithCtx(pattern), Message.Topic() shows the topic of message.
+//New topics are discovered every KafkaCfg.TopicDiscoveryInterval.
+//Topics, which are already registered by ReaderRegister, and retry topics are skipped.
+func (q *Queue) PatternRegister(pattern string) error {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return fmt.Errorf("incorrect topic pattern %v: %v", pattern, err)
+	}
+	q.m.Lock()
+	if _, ok := q.messages[pattern]; ok {
+		q.m.Unlock()
+		return nil
+	}
+	q.patterns[pattern] = re
+	q.messages[pattern] = make(chan *Message)
+	q.m.Unlock()
+	return q.matchTopics()
+}
+
+//discoverTopics periodically registers readers for new topics, matching patterns
+func (q *Queue) discoverTopics() {
+	interval := q.cfg.TopicDiscoveryInterval
+	if interval <= 0 {
+		interval = defaultTopicDiscoveryInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-q.closing:
+			return
+		case <-t.C:
+		}
+		q.m.RLock()
+		empty := len(q.patterns) == 0
+		q.m.RUnlock()
+		if empty {
+			continue
+		}
+		err := q.matchTopics()
+		if err != nil {
+			q.logger.Errorf("err during topic discovery: %v", err)
+		}
+	}
+}
+
+//matchTopics registers readers for all unregistered topics, matching patterns
+func (q *Queue) matchTopics() error {
+	err := q.srm.RefreshMetadata()
+	if err != nil {
+		return fmt.Errorf("cant refresh metadata: %v", err)
+	}
+	topics, err := q.srm.Topics()
+	if err != nil {
+		return fmt.Errorf("cant list topics: %v", err)
+	}
+
+	q.m.Lock()
+	defer q.m.Unlock()
+	for pattern, re := range q.patterns {
+		for _, topic := range topics {
+			if !re.MatchString(topic) {
+				continue
+			}
+			if _, ok := q.readers[topic]; ok {
+				continue
+			}
+			if _, ok := q.retryTiers[topic]; ok {
+				continue
+			}
+			q.logger.Infof("topic %v matches pattern %v, registering reader", topic, pattern)
+			err := q.registerReaders(topic, pattern, q.messages[pattern])
+			if err != nil {
+				q.logger.Errorf("cant register reader of %v: %v", topic, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package kafkaadapt
+
+import (
+	"context"
+	"fmt"
+)
+
+//Pause stops fetching messages from topic (and its retry topics) without leaving consumer group.
+//Topic can also be a pattern, registered by PatternRegister, then all its topics are paused.
+//Messages, which are already fetched, are still delivered.
+func (q *Queue) Pause(topic string) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if _, ok := q.messages[topic]; !ok {
+		return fmt.Errorf("there is no such topic declared in config: %v", topic)
+	}
+	if _, ok := q.paused[topic]; !ok {
+		q.paused[topic] = make(chan struct{})
+	}
+	return nil
+}
+
+//Resume continues fetching messages from paused topic
+func (q *Queue) Resume(topic string) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if _, ok := q.messages[topic]; !ok {
+		return fmt.Errorf("there is no such topic declared in config: %v", topic)
+	}
+	if ch, ok := q.paused[topic]; ok {
+		close(ch)
+		delete(q.paused, topic)
+	}
+	return nil
+}
+
+func (q *Queue) Paused(topic string) bool {
+	q.m.RLock()
+	defer q.m.RUnlock()
+	_, ok := q.paused[topic]
+	return ok
+}
+
+//waitResumed blocks while messages channel of given name is paused, returns false if ctx was closed
+func (q *Queue) waitResumed(ctx context.Context, name string) bool {
+	q.m.RLock()
+	ch, ok := q.paused[name]
+	q.m.RUnlock()
+	if !ok {
+		return true
+	}
+	select {
+	case <-ch:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,366 @@
+package kafkaadapt
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+//the same as default RebalanceTimeout of kafka-go consumer group:
+//member, which doesn't rejoin group during it, is excluded from group
+const revokeTimeout = 30 * time.Second
+
+var errGenerationEnded = fmt.Errorf("consumer group generation is over, partitions are revoked")
+
+//rebalanceHooks reports whether KafkaCfg has any of rebalance callbacks.
+//consumer group is read by generations then, see groupMember
+func (q *Queue) rebalanceHooks() bool {
+	return q.cfg.ConsumerGroupID != "" && (q.cfg.OnPartitionsAssigned != nil || q.cfg.OnPartitionsRevoked != nil)
+}
+
+//groupMember is consumer group member of single read topic.
+//Each generation partitions, assigned to member, are read by group-less readers and offsets are committed through generation,
+//so partitions are revoked only after their in-flight messages, before member rejoins group.
+type groupMember struct {
+	topic    string
+	stop     chan struct{}
+	stopOnce sync.Once
+	//signals to leave group and join it anew, so whole group is rebalanced
+	rejoin chan struct{}
+	//closed when member has left group
+	done chan struct{}
+}
+
+func (m *groupMember) halt() {
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+//wait blocks until member leaves group or ctx is done
+func (m *groupMember) wait(ctx context.Context) error {
+	select {
+	case <-m.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("consumer group member of %v is not stopped: %v", m.topic, ctx.Err())
+	}
+}
+
+//addMember starts consumer group member of topic, must be called under q.m
+func (q *Queue) addMember(topic string) {
+	m := &groupMember{
+		topic:  topic,
+		stop:   make(chan struct{}),
+		rejoin: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	q.members[topic] = m
+	go q.runMember(m)
+}
+
+//rejoinMember makes member of topic rejoin consumer group
+func (q *Queue) rejoinMember(topic string) {
+	q.m.RLock()
+	m, ok := q.members[topic]
+	q.m.RUnlock()
+	if !ok {
+		return
+	}
+	select {
+	case m.rejoin <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) runMember(m *groupMember) {
+	defer close(m.done)
+	for {
+		cg, err := kafka.NewConsumerGroup(q.groupConfig(m.topic))
+		if err != nil {
+			q.logger.Errorf("cant create consumer group member of %v: %v", m.topic, err)
+			return
+		}
+		if !q.consumeGenerations(m, cg) {
+			return
+		}
+	}
+}
+
+func (q *Queue) groupConfig(topic string) kafka.ConsumerGroupConfig {
+	return kafka.ConsumerGroupConfig{
+		ID:          q.cfg.ConsumerGroupID,
+		Brokers:     q.cfg.Brokers,
+		Dialer:      q.readerConfig(topic).Dialer,
+		Topics:      []string{topic},
+		StartOffset: kafka.FirstOffset,
+	}
+}
+
+//consumeGenerations reads generations of cg until member is stopped or has to rejoin group.
+//cg is closed on return, returns true if member has to join group anew.
+func (q *Queue) consumeGenerations(m *groupMember, cg *kafka.ConsumerGroup) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-m.stop:
+		case <-q.closed:
+		case <-m.rejoin:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	for {
+		gen, err := cg.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			q.logger.Errorf("err during joining consumer group %v by %v: %v", q.cfg.ConsumerGroupID, m.topic, err)
+			continue
+		}
+		q.startGeneration(m, gen)
+	}
+	//закрытие завершает текущее поколение, дожидаясь отзыва его партиций, и выводит участника из группы
+	err := cg.Close()
+	if err != nil {
+		q.logger.Errorf("err during consumer group closing: %v", err)
+	}
+	select {
+	case <-m.stop:
+		return false
+	case <-q.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+//groupGeneration is consumer group generation of topic, which partitions are read by this instance
+type groupGeneration struct {
+	topic      string
+	partitions []int
+	//commits offsets through generation, Generation.CommitOffsets
+	commitOffsets func(map[string]map[int]int64) error
+	//offsets of the next messages to read by partition: assigned ones, then committed
+	offsets map[int]int64
+	readers []*kafka.Reader
+	ended   bool
+
+	m sync.Mutex
+}
+
+func newGroupGeneration(topic string, assignments []kafka.PartitionAssignment, commit func(map[string]map[int]int64) error) *groupGeneration {
+	g := &groupGeneration{
+		topic:         topic,
+		commitOffsets: commit,
+		offsets:       make(map[int]int64),
+	}
+	for _, a := range assignments {
+		g.partitions = append(g.partitions, a.ID)
+		g.offsets[a.ID] = a.Offset
+	}
+	sort.Ints(g.partitions)
+	return g
+}
+
+//commit commits offsets of acked msgs, offsets, which were already committed, are skipped
+func (g *groupGeneration) commit(msgs ...kafka.Message) error {
+	offsets := make(map[int]int64)
+	g.m.Lock()
+	defer g.m.Unlock()
+	for _, msg := range msgs {
+		//как и в коммитах kafka, коммитится оффсет следующего сообщения
+		next := msg.Offset + 1
+		if next <= g.offsets[msg.Partition] || next <= offsets[msg.Partition] {
+			continue
+		}
+		offsets[msg.Partition] = next
+	}
+	return g.commitLocked(offsets)
+}
+
+//seek commits given offsets of the next messages to read, even if they are less than committed ones
+func (g *groupGeneration) seek(offsets map[int]int64) error {
+	g.m.Lock()
+	defer g.m.Unlock()
+	return g.commitLocked(offsets)
+}
+
+//commitLocked commits offsets, must be called under g.m
+func (g *groupGeneration) commitLocked(offsets map[int]int64) error {
+	if len(offsets) == 0 {
+		return nil
+	}
+	if g.ended {
+		return errGenerationEnded
+	}
+	err := g.commitOffsets(map[string]map[int]int64{g.topic: offsets})
+	if err != nil {
+		return err
+	}
+	for p, offset := range offsets {
+		g.offsets[p] = offset
+	}
+	return nil
+}
+
+//offset returns offset of the next message of partition to read
+func (g *groupGeneration) offset(partition int) int64 {
+	g.m.Lock()
+	defer g.m.Unlock()
+	return g.offsets[partition]
+}
+
+//replace changes reader of generation to recreated one
+func (g *groupGeneration) replace(old, r *kafka.Reader) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	for i := range g.readers {
+		if g.readers[i] == old {
+			g.readers[i] = r
+		}
+	}
+}
+
+//end stops commits and closes readers of generation
+func (g *groupGeneration) end(logger Logger) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.ended = true
+	closeReaders(logger, g.readers)
+}
+
+//startGeneration starts readers of partitions, assigned to member, and calls assignment hook.
+//generation ends with revocation of all its partitions, see endGeneration
+func (q *Queue) startGeneration(m *groupMember, gen *kafka.Generation) {
+	g := newGroupGeneration(m.topic, gen.Assignments[m.topic], gen.CommitOffsets)
+	for _, p := range g.partitions {
+		g.readers = append(g.readers, q.partitionReader(m.topic, p, g.offsets[p]))
+	}
+
+	q.adminLock.Lock()
+	q.m.Lock()
+	tr, ok := q.readers[m.topic]
+	registered := ok && q.members[m.topic] == m
+	if registered {
+		q.startGenerationReaders(tr, g)
+	}
+	q.m.Unlock()
+	q.adminLock.Unlock()
+	if !registered {
+		g.end(q.logger)
+		return
+	}
+
+	//отзыв партиций вызывается только после их назначения
+	assigned := make(chan struct{})
+	gen.Start(func(ctx context.Context) {
+		<-ctx.Done()
+		<-assigned
+		q.endGeneration(g)
+	})
+	if len(g.partitions) > 0 {
+		q.partitionsAssigned(m.topic, g.partitions)
+	}
+	close(assigned)
+}
+
+//startGenerationReaders replaces stopped readers of topic with readers of generation, must be called under q.m
+func (q *Queue) startGenerationReaders(tr *topicReaders, g *groupGeneration) {
+	size := readerChanSize
+	if len(g.readers) > size {
+		size = len(g.readers)
+	}
+	ntr := &topicReaders{
+		topic:     tr.topic,
+		name:      tr.name,
+		rch:       make(chan *kafka.Reader, size),
+		msgs:      tr.msgs,
+		stop:      make(chan struct{}),
+		shrink:    tr.shrink,
+		offset:    tr.offset,
+		inflight:  tr.inflight,
+		producers: tr.producers,
+		gen:       g,
+	}
+	for _, r := range g.readers {
+		ntr.rch <- r
+		ntr.count++
+		ntr.producers.Add(1)
+		go q.produceMessages(ntr)
+	}
+	q.readers[tr.topic] = ntr
+}
+
+//endGeneration stops readers of ended generation, waits for their in-flight messages and calls revocation hook.
+//consumer group doesn't rejoin until it returns, so acks of these messages are still committed by the generation.
+func (q *Queue) endGeneration(g *groupGeneration) {
+	ctx, cancel := context.WithTimeout(context.Background(), revokeTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-q.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	select {
+	case <-q.closing:
+		//закрывающаяся очередь сама дожидается in-flight сообщений и закрывает ридеры
+	default:
+		q.stopGenerationReaders(ctx, g)
+	}
+	if len(g.partitions) > 0 {
+		q.partitionsRevoked(ctx, g.topic, g.partitions)
+	}
+	g.end(q.logger)
+}
+
+//stopGenerationReaders stops producers of generation readers and waits for in-flight messages
+func (q *Queue) stopGenerationReaders(ctx context.Context, g *groupGeneration) {
+	q.adminLock.Lock()
+	defer q.adminLock.Unlock()
+	q.m.RLock()
+	tr, ok := q.readers[g.topic]
+	q.m.RUnlock()
+	//ридеры снятого с чтения топика уже остановлены
+	if !ok || tr.gen != g {
+		return
+	}
+	tr.halt()
+	_, err := q.collectReaders(ctx, tr)
+	if err != nil {
+		q.logger.Errorf("in-flight messages of %v are not acked before revocation: %v", g.topic, err)
+	}
+	q.m.Lock()
+	tr.count = 0
+	q.m.Unlock()
+	q.acks.forget(g.topic)
+}
+
+func (q *Queue) partitionsAssigned(topic string, partitions []int) {
+	if q.cfg.OnPartitionsAssigned == nil {
+		return
+	}
+	defer q.recoverHook("OnPartitionsAssigned")
+	q.cfg.OnPartitionsAssigned(topic, partitions)
+}
+
+func (q *Queue) partitionsRevoked(ctx context.Context, topic string, partitions []int) {
+	if q.cfg.OnPartitionsRevoked == nil {
+		return
+	}
+	defer q.recoverHook("OnPartitionsRevoked")
+	q.cfg.OnPartitionsRevoked(ctx, topic, partitions)
+}
+
+func (q *Queue) recoverHook(name string) {
+	if r := recover(); r != nil {
+		q.logger.Errorf("panic in %v: %v", name, r)
+	}
+}
@@ -0,0 +1,123 @@
+package kafkaadapt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+//testGeneration returns generation of orders with partitions 2 and 0, which commits are recorded
+func testGeneration(commitErr *error) (*groupGeneration, *[]map[int]int64) {
+	var commits []map[int]int64
+	g := newGroupGeneration("orders", []kafka.PartitionAssignment{{ID: 2, Offset: 10}, {ID: 0, Offset: 5}},
+		func(offsets map[string]map[int]int64) error {
+			if *commitErr != nil {
+				return *commitErr
+			}
+			commits = append(commits, offsets["orders"])
+			return nil
+		})
+	return g, &commits
+}
+
+func TestGroupGenerationAssignments(t *testing.T) {
+	var commitErr error
+	g, _ := testGeneration(&commitErr)
+	if want := []int{0, 2}; !reflect.DeepEqual(g.partitions, want) {
+		t.Fatalf("got partitions %v, want %v", g.partitions, want)
+	}
+	if g.offset(0) != 5 || g.offset(2) != 10 {
+		t.Fatalf("got offsets %v and %v, want assigned 5 and 10", g.offset(0), g.offset(2))
+	}
+}
+
+func TestGroupGenerationCommit(t *testing.T) {
+	var commitErr error
+	g, commits := testGeneration(&commitErr)
+
+	err := g.commit(
+		kafka.Message{Partition: 0, Offset: 7},
+		kafka.Message{Partition: 0, Offset: 6},
+		//уже прочитанные до назначения сообщения не коммитятся
+		kafka.Message{Partition: 2, Offset: 8},
+	)
+	if err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if want := []map[int]int64{{0: 8}}; !reflect.DeepEqual(*commits, want) {
+		t.Fatalf("got commits %v, want %v", *commits, want)
+	}
+	if g.offset(0) != 8 {
+		t.Fatalf("got offset %v, want 8", g.offset(0))
+	}
+
+	//подтверждение старого сообщения не откатывает оффсет
+	if err := g.commit(kafka.Message{Partition: 0, Offset: 3}); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if len(*commits) != 1 {
+		t.Fatalf("old offset is committed: %v", *commits)
+	}
+}
+
+func TestGroupGenerationCommitError(t *testing.T) {
+	commitErr := errors.New("broker is not available")
+	g, _ := testGeneration(&commitErr)
+
+	if err := g.commit(kafka.Message{Partition: 0, Offset: 7}); err != commitErr {
+		t.Fatalf("got %v, want commit error", err)
+	}
+	if g.offset(0) != 5 {
+		t.Fatalf("offset is changed by failed commit: %v", g.offset(0))
+	}
+}
+
+func TestGroupGenerationSeek(t *testing.T) {
+	var commitErr error
+	g, commits := testGeneration(&commitErr)
+
+	if err := g.seek(map[int]int64{2: 1}); err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	if want := []map[int]int64{{2: 1}}; !reflect.DeepEqual(*commits, want) {
+		t.Fatalf("got commits %v, want %v", *commits, want)
+	}
+	if g.offset(2) != 1 {
+		t.Fatalf("got offset %v, want 1", g.offset(2))
+	}
+}
+
+func TestGroupGenerationEnded(t *testing.T) {
+	var commitErr error
+	g, commits := testGeneration(&commitErr)
+	g.end(discardTestLogger{})
+
+	//после отзыва партиций их оффсеты коммитит уже новый владелец
+	if err := g.commit(kafka.Message{Partition: 0, Offset: 7}); err != errGenerationEnded {
+		t.Fatalf("got %v, want errGenerationEnded", err)
+	}
+	if err := g.seek(map[int]int64{0: 0}); err != errGenerationEnded {
+		t.Fatalf("got %v, want errGenerationEnded", err)
+	}
+	if len(*commits) != 0 {
+		t.Fatalf("offsets are committed after generation end: %v", *commits)
+	}
+	//нечего коммитить - нечего и отвергать
+	if err := g.commit(kafka.Message{Partition: 0, Offset: 1}); err != nil {
+		t.Fatalf("got %v for already committed offset", err)
+	}
+}
+
+func TestGroupGenerationReplace(t *testing.T) {
+	var commitErr error
+	g, _ := testGeneration(&commitErr)
+	old, other, r := &kafka.Reader{}, &kafka.Reader{}, &kafka.Reader{}
+	g.readers = []*kafka.Reader{old, other}
+
+	g.replace(old, r)
+	if g.readers[0] != r || g.readers[1] != other {
+		t.Fatal("recreated reader must replace only the old one")
+	}
+}
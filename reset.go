@@ -0,0 +1,213 @@
+package kafkaadapt
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	sarama "github.com/Shopify/sarama"
+)
+
+type OffsetResetKind int
+
+const (
+	ResetToEarliest OffsetResetKind = iota
+	ResetToLatest
+	ResetToTime
+	ResetShiftBy
+	ResetToOffset
+)
+
+type ResetOffsetsOptions struct {
+	Kind OffsetResetKind
+
+	//target time for ResetToTime, partitions without messages after it are reset to the end
+	Time time.Time
+	//shift for ResetShiftBy, negative value moves offsets back
+	Shift int64
+	//target offset for ResetToOffset
+	Offset int64
+
+	//only calculates new offsets without committing them
+	DryRun bool
+	//allows reset of topic, read by this instance, while consumer group has active members of other instances,
+	//reset is done like SeekToOffsets then. Members of this instance are always allowed.
+	//offsets of topic, which is not read by this instance, can be reset only in empty group, Force doesn't change it
+	Force bool
+}
+
+//PartitionOffsets holds committed offset of partition before and after reset, -1 means there was no committed offset
+type PartitionOffsets struct {
+	Partition int
+	Before    int64
+	After     int64
+}
+
+//ResetOffsets resets ConsumerGroupID offsets of all topic partitions, found by metadata.
+//New offsets are kept in range of available messages.
+//Returns offsets before and after reset (committed or calculated in DryRun mode).
+//Offsets of topic, read by this instance, are calculated once more after its in-flight messages are acked/nacked,
+//so shift is applied to actual committed offsets.
+func (q *Queue) ResetOffsets(ctx context.Context, topic string, opts ResetOffsetsOptions) ([]PartitionOffsets, error) {
+	if q.cfg.ConsumerGroupID == "" {
+		return nil, fmt.Errorf("cant reset offsets of %v: %v", topic, ErrNoConsumerGroup)
+	}
+	partitions, err := q.srm.Partitions(topic)
+	if err != nil {
+		return nil, fmt.Errorf("cant get partitions of %v: %v", topic, err)
+	}
+	a, err := sarama.NewClusterAdmin(q.cfg.Brokers, q.GetSaramaConfig())
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	res, err := q.resetPlan(a, topic, partitions, opts)
+	if err != nil || opts.DryRun {
+		return res, err
+	}
+
+	groups, err := a.DescribeConsumerGroups([]string{q.cfg.ConsumerGroupID})
+	if err != nil {
+		return nil, fmt.Errorf("cant describe consumer group %v: %v", q.cfg.ConsumerGroupID, err)
+	}
+	var members, foreign int
+	if len(groups) > 0 {
+		members = len(groups[0].Members)
+		for _, m := range groups[0].Members {
+			if m.ClientId != q.clientID {
+				foreign++
+			}
+		}
+	}
+	q.m.RLock()
+	_, own := q.readers[topic]
+	q.m.RUnlock()
+	if !own {
+		// коммит не от участника группы брокер принимает только для пустой группы
+		if members > 0 {
+			return nil, fmt.Errorf("consumer group %v has %v active members, offsets of %v, which is not read by this instance, can be reset only in empty group",
+				q.cfg.ConsumerGroupID, members, topic)
+		}
+		return res, q.commitGroupOffsets(topic, res)
+	}
+	if foreign > 0 && !opts.Force {
+		return nil, fmt.Errorf("consumer group %v has %v active members of other instances, stop them or use Force", q.cfg.ConsumerGroupID, foreign)
+	}
+	err = q.seek(ctx, topic, func() (map[int]int64, error) {
+		//оффсеты пересчитываются после коммита in-flight сообщений, иначе сдвиг считается от устаревших
+		res, err = q.resetPlan(a, topic, partitions, opts)
+		if err != nil {
+			return nil, err
+		}
+		offsets := make(map[int]int64)
+		for _, r := range res {
+			offsets[r.Partition] = r.After
+		}
+		return offsets, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+//resetPlan reads committed offsets of topic partitions and calculates new ones
+func (q *Queue) resetPlan(a sarama.ClusterAdmin, topic string, partitions []int32, opts ResetOffsetsOptions) ([]PartitionOffsets, error) {
+	committed, err := a.ListConsumerGroupOffsets(q.cfg.ConsumerGroupID, map[string][]int32{topic: partitions})
+	if err != nil {
+		return nil, fmt.Errorf("cant get committed offsets of %v: %v", topic, err)
+	}
+	res := make([]PartitionOffsets, 0, len(partitions))
+	for _, p := range partitions {
+		before := int64(-1)
+		if b := committed.GetBlock(topic, p); b != nil && b.Err == sarama.ErrNoError {
+			before = b.Offset
+		}
+		after, err := q.resetTarget(topic, p, before, opts)
+		if err != nil {
+			return nil, fmt.Errorf("cant calculate offset of %v[%v]: %v", topic, p, err)
+		}
+		res = append(res, PartitionOffsets{Partition: int(p), Before: before, After: after})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Partition < res[j].Partition })
+	return res, nil
+}
+
+//resetTarget calculates new offset of partition
+func (q *Queue) resetTarget(topic string, p int32, before int64, opts ResetOffsetsOptions) (int64, error) {
+	oldest, err := q.srm.GetOffset(topic, p, sarama.OffsetOldest)
+	if err != nil {
+		return 0, err
+	}
+	newest, err := q.srm.GetOffset(topic, p, sarama.OffsetNewest)
+	if err != nil {
+		return 0, err
+	}
+
+	var offset int64
+	switch opts.Kind {
+	case ResetToEarliest:
+		offset = oldest
+	case ResetToLatest:
+		offset = newest
+	case ResetToTime:
+		offset, err = q.srm.GetOffset(topic, p, opts.Time.UnixNano()/int64(time.Millisecond))
+		if err != nil {
+			return 0, err
+		}
+		if offset < 0 {
+			offset = newest
+		}
+	case ResetShiftBy:
+		offset = before
+		if offset < 0 {
+			offset = oldest
+		}
+		offset += opts.Shift
+	case ResetToOffset:
+		offset = opts.Offset
+	default:
+		return 0, fmt.Errorf("unknown reset kind %v", opts.Kind)
+	}
+
+	if offset < oldest {
+		offset = oldest
+	}
+	if offset > newest {
+		offset = newest
+	}
+	return offset, nil
+}
+
+//commitGroupOffsets commits offsets not being a member of consumer group, it's possible only for empty group
+func (q *Queue) commitGroupOffsets(topic string, offsets []PartitionOffsets) error {
+	coordinator, err := q.srm.Coordinator(q.cfg.ConsumerGroupID)
+	if err != nil {
+		return fmt.Errorf("cant get coordinator of consumer group %v: %v", q.cfg.ConsumerGroupID, err)
+	}
+	req := &sarama.OffsetCommitRequest{
+		Version:                 2,
+		ConsumerGroup:           q.cfg.ConsumerGroupID,
+		ConsumerGroupGeneration: -1,
+		RetentionTime:           -1,
+	}
+	for _, o := range offsets {
+		req.AddBlock(topic, int32(o.Partition), o.After, 0, "modified by kafka-adapter")
+	}
+	resp, err := coordinator.CommitOffset(req)
+	if err != nil {
+		return fmt.Errorf("cant commit offsets of %v: %v", topic, err)
+	}
+	var errs []string
+	for p, kerr := range resp.Errors[topic] {
+		if kerr != sarama.ErrNoError {
+			errs = append(errs, fmt.Sprintf("%v[%v]: %v", topic, p, kerr))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("cant commit offsets: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
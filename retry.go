@@ -0,0 +1,119 @@
+package kafkaadapt
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+//HeaderRetryDue holds unix time in milliseconds, before which message from retry topic is not delivered
+const HeaderRetryDue = "x-retry-due"
+
+type RetryPolicy struct {
+	//delays of retry tiers, each tier has its own topic named by RetryTopicName, e.g. orders.retry.5s
+	//readers and writers for retry topics are registered automatically with read topic, topics must exist
+	Delays []time.Duration
+}
+
+//retryTier describes retry topic
+type retryTier struct {
+	origin string
+	index  int
+}
+
+//RetryTopicName returns name of retry topic for given topic and delay, e.g. orders.retry.5s, orders.retry.1m
+func RetryTopicName(topic string, delay time.Duration) string {
+	var d string
+	switch {
+	case delay%time.Hour == 0:
+		d = fmt.Sprintf("%dh", delay/time.Hour)
+	case delay%time.Minute == 0:
+		d = fmt.Sprintf("%dm", delay/time.Minute)
+	case delay%time.Second == 0:
+		d = fmt.Sprintf("%ds", delay/time.Second)
+	default:
+		d = fmt.Sprintf("%dms", delay/time.Millisecond)
+	}
+	return fmt.Sprintf("%v.retry.%v", topic, d)
+}
+
+//retryTopics returns names of retry topics for given topic
+func (q *Queue) retryTopics(topic string) []string {
+	var res []string
+	for _, delay := range q.cfg.RetryPolicies[topic].Delays {
+		res = append(res, RetryTopicName(topic, delay))
+	}
+	return res
+}
+
+//reroute publishes nacked msg to the next retry topic or to dead-letter topic.
+//returns true if message was published and has to be acked.
+func (q *Queue) reroute(msg *kafka.Message, reason error) (bool, error) {
+	q.m.RLock()
+	tier, isTier := q.retryTiers[msg.Topic]
+	q.m.RUnlock()
+	origin, next := msg.Topic, 0
+	if isTier {
+		origin, next = tier.origin, tier.index+1
+	}
+	policy, ok := q.cfg.RetryPolicies[origin]
+	if !ok || len(policy.Delays) == 0 {
+		return q.deadLetter(msg, reason)
+	}
+
+	failures := next + 1
+	if next >= len(policy.Delays) {
+		dl, ok := q.cfg.DeadLetterPolicies[origin]
+		if ok && dl.DeadLetterTopic != "" {
+			err := q.publishFailed(msg, dl.DeadLetterTopic, failures, reason)
+			return err == nil, err
+		}
+		//retries are exhausted, but there is no dead-letter topic, so message stays in the last retry topic
+		next = len(policy.Delays) - 1
+	}
+	delay := policy.Delays[next]
+	due := time.Now().Add(delay).UnixNano() / int64(time.Millisecond)
+	err := q.publishFailed(msg, RetryTopicName(origin, delay), failures, reason,
+		Header{Key: HeaderRetryDue, Value: []byte(strconv.FormatInt(due, 10))})
+	return err == nil, err
+}
+
+//waitRetryDue holds message from retry topic until its due time or ctx closing.
+//returns false if ctx is done before due time, message mustn't be delivered then.
+func (q *Queue) waitRetryDue(ctx context.Context, msg *kafka.Message) bool {
+	v := lastHeader(msg.Headers, HeaderRetryDue)
+	if v == nil {
+		return true
+	}
+	q.m.RLock()
+	_, isTier := q.retryTiers[msg.Topic]
+	q.m.RUnlock()
+	if !isTier {
+		return true
+	}
+	due, err := strconv.ParseInt(string(v), 10, 64)
+	if err != nil {
+		q.logger.Errorf("incorrect %v header in message from %v at offset %v: %v", HeaderRetryDue, msg.Topic, msg.Offset, err)
+		return true
+	}
+	d := time.Until(time.Unix(0, due*int64(time.Millisecond)))
+	if d <= 0 {
+		return true
+	}
+	//ожидающие сообщения не считаются зависшими, см. checkTopic
+	delayed := &q.stats.topic(msg.Topic).delayed
+	atomic.AddInt64(delayed, 1)
+	defer atomic.AddInt64(delayed, -1)
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,44 @@
+package kafkaadapt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryTopicName(t *testing.T) {
+	cases := []struct {
+		delay time.Duration
+		want  string
+	}{
+		{5 * time.Second, "orders.retry.5s"},
+		{90 * time.Second, "orders.retry.90s"},
+		{time.Minute, "orders.retry.1m"},
+		{10 * time.Minute, "orders.retry.10m"},
+		{2 * time.Hour, "orders.retry.2h"},
+		{1500 * time.Millisecond, "orders.retry.1500ms"},
+	}
+	for _, c := range cases {
+		if got := RetryTopicName("orders", c.delay); got != c.want {
+			t.Errorf("RetryTopicName(%v) = %v, want %v", c.delay, got, c.want)
+		}
+	}
+}
+
+func TestRetryTopics(t *testing.T) {
+	q := &Queue{cfg: KafkaCfg{RetryPolicies: map[string]RetryPolicy{
+		"orders": {Delays: []time.Duration{5 * time.Second, time.Minute}},
+	}}}
+	got := q.retryTopics("orders")
+	want := []string{"orders.retry.5s", "orders.retry.1m"}
+	if len(got) != len(want) {
+		t.Fatalf("retryTopics = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("retryTopics = %v, want %v", got, want)
+		}
+	}
+	if got := q.retryTopics("payments"); len(got) != 0 {
+		t.Fatalf("topic without policy must have no retry topics, got %v", got)
+	}
+}
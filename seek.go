@@ -0,0 +1,127 @@
+package kafkaadapt
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	sarama "github.com/Shopify/sarama"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+//SeekToTime moves ConsumerGroupID offsets of every topic partition to the first message at or after t,
+//partitions without such messages are moved to their end. See SeekToOffsets.
+func (q *Queue) SeekToTime(ctx context.Context, topic string, t time.Time) error {
+	partitions, err := q.srm.Partitions(topic)
+	if err != nil {
+		return fmt.Errorf("cant get partitions of %v: %v", topic, err)
+	}
+	offsets := make(map[int]int64)
+	for _, p := range partitions {
+		offset, err := q.srm.GetOffset(topic, p, t.UnixNano()/int64(time.Millisecond))
+		if err == nil && offset < 0 {
+			offset, err = q.srm.GetOffset(topic, p, sarama.OffsetNewest)
+		}
+		if err != nil {
+			return fmt.Errorf("cant get offset of %v[%v] for %v: %v", topic, p, t, err)
+		}
+		offsets[int(p)] = offset
+	}
+	return q.SeekToOffsets(ctx, topic, offsets)
+}
+
+//SeekToOffsets commits given offsets (by partition) of registered read topic for ConsumerGroupID
+//(or saves them into OffsetStore) and recreates topic readers,
+//so consumer group is rebalanced and all its members continue from new offsets.
+//Waits until in-flight messages of topic are acked/nacked, commits of other group instances,
+//made after seeking, can overwrite new offsets.
+//With rebalance hooks offsets are committed through current consumer group generation,
+//so some partitions of topic have to be assigned to this instance, and instance rejoins group after seeking.
+func (q *Queue) SeekToOffsets(ctx context.Context, topic string, offsets map[int]int64) error {
+	return q.seek(ctx, topic, func() (map[int]int64, error) {
+		return offsets, nil
+	})
+}
+
+//seek commits offsets, returned by target after in-flight messages of topic are acked/nacked and committed,
+//and recreates topic readers
+func (q *Queue) seek(ctx context.Context, topic string, target func() (map[int]int64, error)) error {
+	if q.cfg.ConsumerGroupID == "" && !q.storesOffsets() {
+		return fmt.Errorf("cant seek %v: %v", topic, ErrNoConsumerGroup)
+	}
+	q.adminLock.Lock()
+	defer q.adminLock.Unlock()
+	q.m.RLock()
+	tr, ok := q.readers[topic]
+	q.m.RUnlock()
+	if !ok {
+		return fmt.Errorf("there is no such topic declared in config: %v", topic)
+	}
+
+	tr.halt()
+	readers, err := q.collectReaders(ctx, tr)
+	if err == nil && len(readers) == 0 {
+		err = fmt.Errorf("no partitions of %v are assigned to this instance now", topic)
+	}
+	if err == nil {
+		err = q.waitAsyncCommits(ctx)
+	}
+	var offsets map[int]int64
+	if err == nil {
+		offsets, err = target()
+	}
+	if err == nil {
+		err = q.commitOffsets(ctx, tr, readers[0], topic, offsets)
+	}
+	// старые ридеры закрываем только после коммита: их выход из группы вызывает ребалансировку,
+	// после которой все участники группы читают уже новые оффсеты.
+	for _, r := range readers {
+		if err == nil {
+			r = q.recreateReader(tr, r)
+		}
+		tr.rch <- r
+	}
+	if err == nil {
+		q.acks.forget(topic)
+	}
+	q.restartReaders(tr)
+	if err != nil {
+		return fmt.Errorf("cant seek %v: %v", topic, err)
+	}
+	//ридеры поколения читают только свои партиции, остальные участники группы узнают новые оффсеты после ребалансировки
+	if tr.gen != nil {
+		q.rejoinMember(topic)
+	}
+	return nil
+}
+
+//waitAsyncCommits waits until commits of acked messages, accumulated by readers in async mode, are sent
+func (q *Queue) waitAsyncCommits(ctx context.Context) error {
+	//поколения консумергруппы и OffsetStore коммитят оффсеты сразу
+	if !q.cfg.AsyncAck || q.storesOffsets() || q.rebalanceHooks() {
+		return nil
+	}
+	// в асинхронном режиме коммиты копятся до тика CommitInterval и из них берется максимальный оффсет,
+	// поэтому ждем, пока накопленные коммиты уйдут, иначе они перекроют сдвиг оффсета назад.
+	t := time.NewTimer(asyncCommitInterval)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//commitOffsets commits offsets through reader, which is a member of consumer group, or generation of topic readers
+func (q *Queue) commitOffsets(ctx context.Context, tr *topicReaders, r *kafka.Reader, topic string, offsets map[int]int64) error {
+	if tr.gen != nil {
+		return tr.gen.seek(offsets)
+	}
+	msgs := make([]kafka.Message, 0, len(offsets))
+	for p, offset := range offsets {
+		//коммитится оффсет следующего за сообщением
+		msgs = append(msgs, kafka.Message{Topic: topic, Partition: p, Offset: offset - 1})
+	}
+	return q.commitMessages(ctx, tr, r, msgs...)
+}
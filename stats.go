@@ -0,0 +1,92 @@
+package kafkaadapt
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//TopicStats contains counters of read topic
+type TopicStats struct {
+	//count of duplicate messages, acked without delivery, see KafkaCfg.DedupeStore
+	Duplicates int64
+	//count of messages from retry topics, waiting for their due time, see RetryPolicy
+	Delayed int64
+
+	//times of the last fetched from kafka, handed out by GetWithCtx and acked messages, zero if there was no such
+	LastFetched   time.Time
+	LastDelivered time.Time
+	LastAcked     time.Time
+}
+
+//topicCounters holds counters of topic, updated atomically
+type topicCounters struct {
+	duplicates int64
+	delayed    int64
+	//unix nanoseconds
+	lastFetched   int64
+	lastDelivered int64
+	lastAcked     int64
+}
+
+func touch(t *int64) {
+	atomic.StoreInt64(t, time.Now().UnixNano())
+}
+
+func loadTime(t *int64) time.Time {
+	n := atomic.LoadInt64(t)
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+type queueStats struct {
+	topics map[string]*topicCounters
+	m      sync.RWMutex
+}
+
+func newQueueStats() *queueStats {
+	return &queueStats{
+		topics: make(map[string]*topicCounters),
+	}
+}
+
+//topic returns counters of topic, creating them if needed
+func (s *queueStats) topic(name string) *topicCounters {
+	s.m.RLock()
+	c, ok := s.topics[name]
+	s.m.RUnlock()
+	if ok {
+		return c
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	c, ok = s.topics[name]
+	if !ok {
+		c = &topicCounters{}
+		s.topics[name] = c
+	}
+	return c
+}
+
+func (c *topicCounters) snapshot() TopicStats {
+	return TopicStats{
+		Duplicates:    atomic.LoadInt64(&c.duplicates),
+		Delayed:       atomic.LoadInt64(&c.delayed),
+		LastFetched:   loadTime(&c.lastFetched),
+		LastDelivered: loadTime(&c.lastDelivered),
+		LastAcked:     loadTime(&c.lastAcked),
+	}
+}
+
+//Stats returns counters of read topics since queue creation
+func (q *Queue) Stats() map[string]TopicStats {
+	q.stats.m.RLock()
+	defer q.stats.m.RUnlock()
+	res := make(map[string]TopicStats, len(q.stats.topics))
+	for topic, c := range q.stats.topics {
+		res[topic] = c.snapshot()
+	}
+	return res
+}
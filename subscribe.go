@@ -0,0 +1,216 @@
+package kafkaadapt
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	orderedWorkerChanSize = 16
+	defaultRetryBackoff   = time.Second
+)
+
+//Handler processes single message, received by Subscribe.
+//nil result acks message, error (or panic) nacks it.
+type Handler func(ctx context.Context, msg *Message) error
+
+type SubscribeOptions struct {
+	//count of workers, calling handler concurrently
+	//default is topic concurrency from KafkaCfg
+	Workers int
+
+	//enables per-key ordered processing:
+	//messages are fanned out to workers by hash of Message.Key (or partition for messages without key),
+	//so messages with the same key are processed strictly in order, while different keys run in parallel.
+	//offsets are committed only for contiguous processed messages of partition.
+	OrderedByKey bool
+
+	//delay before handler retry in OrderedByKey mode
+	//failed message, which wasn't routed to retry or dead-letter topic, is retried by the same worker to keep key order
+	//default is 1s
+	RetryBackoff time.Duration
+}
+
+//Subscribe reads messages from topic and passes them to handler by worker pool, taking care of Ack/Nack.
+//Blocks until ctx is done (returns nil), queue is closed (returns ErrClosed)
+//or topic reader is unregistered (returns ErrUnregistered), waiting for running handlers.
+//Topic must be registered by config or ReaderRegister before.
+func (q *Queue) Subscribe(ctx context.Context, topic string, handler Handler, opts SubscribeOptions) error {
+	q.m.RLock()
+	_, ok := q.messages[topic]
+	q.m.RUnlock()
+	if !ok {
+		return fmt.Errorf("there is no such topic declared in config: %v", topic)
+	}
+	if opts.Workers < 1 {
+		opts.Workers = q.cfg.concurrency(topic)
+	}
+	if opts.OrderedByKey {
+		return q.subscribeOrdered(ctx, topic, handler, opts)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var stopErr error
+	var once sync.Once
+	wg := sync.WaitGroup{}
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				msg, err := q.GetWithCtx(ctx, topic)
+				if err == ErrClosed || err == ErrUnregistered {
+					once.Do(func() { stopErr = err })
+					return
+				}
+				if err != nil {
+					return
+				}
+				q.handle(ctx, topic, msg, handler)
+			}
+		}()
+	}
+	wg.Wait()
+	return stopErr
+}
+
+//handle calls handler for single message and acks/nacks it according to result
+func (q *Queue) handle(ctx context.Context, topic string, msg *Message, handler Handler) {
+	err := call(ctx, msg, handler)
+	if err != nil {
+		q.logger.Errorf("error during handling message from topic %v at offset %v: %v", topic, msg.Offset(), err)
+		err = msg.NackWithError(err)
+		if err != nil {
+			q.logger.Errorf("err during message nack: %v", err)
+		}
+		return
+	}
+	err = msg.Ack()
+	if err != nil {
+		q.logger.Errorf("err during message ack: %v", err)
+	}
+}
+
+//call calls handler, recovering its panic
+func call(ctx context.Context, msg *Message, handler Handler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic in handler: %v", r)
+		}
+	}()
+	return handler(ctx, msg)
+}
+
+//subscribeOrdered dispatches messages to workers by key hash, see SubscribeOptions.OrderedByKey
+func (q *Queue) subscribeOrdered(ctx context.Context, topic string, handler Handler, opts SubscribeOptions) error {
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = defaultRetryBackoff
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	q.m.Lock()
+	q.ordered[topic]++
+	q.m.Unlock()
+	defer func() {
+		q.m.Lock()
+		q.ordered[topic]--
+		if q.ordered[topic] == 0 {
+			delete(q.ordered, topic)
+		}
+		q.m.Unlock()
+	}()
+
+	workers := make([]chan *Message, opts.Workers)
+	wg := sync.WaitGroup{}
+	for i := range workers {
+		workers[i] = make(chan *Message, orderedWorkerChanSize)
+		wg.Add(1)
+		go func(ch chan *Message) {
+			defer wg.Done()
+			for msg := range ch {
+				q.handleOrdered(ctx, topic, msg, handler, opts.RetryBackoff)
+			}
+		}(workers[i])
+	}
+
+	var stopErr error
+	for {
+		msg, err := q.GetWithCtx(ctx, topic)
+		if err != nil {
+			if err == ErrClosed || err == ErrUnregistered {
+				stopErr = err
+			}
+			break
+		}
+		// ридер не удерживается сообщением, порядок внутри ключа обеспечивает воркер,
+		// а оффсет коммитится только до первого необработанного сообщения партиции.
+		msg.detach()
+		workers[workerOf(msg, len(workers))] <- msg
+	}
+	for _, ch := range workers {
+		close(ch)
+	}
+	wg.Wait()
+	return stopErr
+}
+
+func workerOf(msg *Message, workers int) int {
+	h := fnv.New32a()
+	if len(msg.Key()) > 0 {
+		h.Write(msg.Key())
+	} else {
+		h.Write([]byte(strconv.Itoa(msg.Partition())))
+	}
+	return int(h.Sum32() % uint32(workers))
+}
+
+//handleOrdered processes message, retrying it in place until success, routing to retry/dead-letter topic or stop.
+//unprocessed message is requeued on stop.
+func (q *Queue) handleOrdered(ctx context.Context, topic string, msg *Message, handler Handler, backoff time.Duration) {
+	for {
+		if ctx.Err() != nil {
+			msg.requeue()
+			return
+		}
+		//истекшая аренда отменяет обработчик, сообщение повторяется на месте, чтобы сохранить порядок ключа
+		hctx, hcancel := context.WithCancel(ctx)
+		msg.runLease(hcancel)
+		err := call(hctx, msg, handler)
+		msg.runLease(nil)
+		hcancel()
+		if err == nil {
+			err = msg.Ack()
+			if err != nil {
+				q.logger.Errorf("err during message ack: %v", err)
+			}
+			return
+		}
+		q.logger.Errorf("error during handling message from topic %v at offset %v: %v", topic, msg.Offset(), err)
+		//сообщение уже возвращено в очередь истекшей арендой до начала упорядоченной подписки
+		if msg.lease.isExpired() {
+			return
+		}
+		sent, rerr := q.reroute(msg.msg, err)
+		if rerr != nil {
+			q.logger.Errorf("err during nacked message routing: %v", rerr)
+		}
+		if sent {
+			err = msg.ackRouted()
+			if err != nil {
+				q.logger.Errorf("err during message ack: %v", err)
+			}
+			return
+		}
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package kafkaadapt
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+type discardTestLogger struct{}
+
+func (discardTestLogger) Errorf(string, ...interface{}) {}
+func (discardTestLogger) Infof(string, ...interface{})  {}
+
+//newTestQueue returns queue with initialized state, but without brokers, readers and writers
+func newTestQueue(cfg KafkaCfg) *Queue {
+	return &Queue{
+		cfg:           cfg,
+		logger:        discardTestLogger{},
+		readers:       make(map[string]*topicReaders),
+		readerOffsets: make(map[string]*int64),
+		messages:      make(map[string]chan *Message),
+		writers:       make(map[string]chan *kafka.Writer),
+		writerCounts:  make(map[string]int),
+		routeWriters:  make(map[string]*kafka.Writer),
+		closed:        make(chan struct{}),
+		closing:       make(chan struct{}),
+		deliveries:    make(map[deliveryKey]int),
+		retryTiers:    make(map[string]retryTier),
+		acks:          newAckTracker(),
+		members:       make(map[string]*groupMember),
+		stats:         newQueueStats(),
+		paused:        make(map[string]chan struct{}),
+		patterns:      make(map[string]*regexp.Regexp),
+		ordered:       make(map[string]int),
+	}
+}
+
+//newTestMessage returns handed out auto-acked message, which doesn't need reader for Ack/Nack
+func newTestMessage(q *Queue, topic string, partition int, offset int64, key string) *Message {
+	var readerOffset int64
+	tr := &topicReaders{
+		topic:     topic,
+		name:      topic,
+		rch:       make(chan *kafka.Reader, 1),
+		stop:      make(chan struct{}),
+		offset:    &readerOffset,
+		inflight:  newInflightCounter(),
+		producers: &sync.WaitGroup{},
+	}
+	msg := &Message{
+		q:     q,
+		msg:   &kafka.Message{Topic: topic, Partition: partition, Offset: offset, Key: []byte(key)},
+		tr:    tr,
+		lease: q.newLease(topic),
+		actualizeOffset: func(o int64) {
+			atomic.StoreInt64(tr.offset, o)
+		},
+	}
+	msg.startLease()
+	return msg
+}
+
+func TestWorkerOf(t *testing.T) {
+	q := newTestQueue(KafkaCfg{})
+	const workers = 4
+	for _, key := range []string{"a", "b", "c", "order-42"} {
+		w := workerOf(newTestMessage(q, "orders", 0, 0, key), workers)
+		for partition := 0; partition < 3; partition++ {
+			//воркер выбирается по ключу, партиция и оффсет не важны
+			if got := workerOf(newTestMessage(q, "orders", partition, int64(partition), key), workers); got != w {
+				t.Fatalf("messages with key %v went to workers %v and %v", key, w, got)
+			}
+		}
+		if w < 0 || w >= workers {
+			t.Fatalf("worker %v is out of range", w)
+		}
+	}
+	//сообщения без ключа распределяются по партициям
+	for partition := 0; partition < 8; partition++ {
+		a := workerOf(newTestMessage(q, "orders", partition, 1, ""), workers)
+		b := workerOf(newTestMessage(q, "orders", partition, 2, ""), workers)
+		if a != b {
+			t.Fatalf("messages without key of partition %v went to workers %v and %v", partition, a, b)
+		}
+	}
+}
+
+func TestHandleOrderedRetriesInPlace(t *testing.T) {
+	q := newTestQueue(KafkaCfg{})
+	msg := newTestMessage(q, "orders", 0, 5, "k")
+
+	var calls int
+	handler := func(ctx context.Context, m *Message) error {
+		calls++
+		if m != msg {
+			t.Fatalf("message must be retried in place")
+		}
+		if calls < 3 {
+			return errors.New("temporary")
+		}
+		return nil
+	}
+	q.handleOrdered(context.Background(), "orders", msg, handler, time.Millisecond)
+	if calls != 3 {
+		t.Fatalf("handler must be called until success, called %v times", calls)
+	}
+	if got := atomic.LoadInt64(msg.tr.offset); got != 5 {
+		t.Fatalf("offset of acked message must be actualized, got %v", got)
+	}
+}
+
+func TestHandleOrderedPanicIsRetried(t *testing.T) {
+	q := newTestQueue(KafkaCfg{})
+	msg := newTestMessage(q, "orders", 0, 1, "k")
+
+	var calls int
+	q.handleOrdered(context.Background(), "orders", msg, func(ctx context.Context, m *Message) error {
+		calls++
+		if calls == 1 {
+			panic("boom")
+		}
+		return nil
+	}, time.Millisecond)
+	if calls != 2 {
+		t.Fatalf("panicked handler must be retried, called %v times", calls)
+	}
+}
+
+func TestHandleOrderedStopsOnCtx(t *testing.T) {
+	q := newTestQueue(KafkaCfg{})
+	msg := newTestMessage(q, "orders", 0, 1, "k")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.handleOrdered(ctx, "orders", msg, func(ctx context.Context, m *Message) error {
+			calls++
+			cancel()
+			return errors.New("failed")
+		}, time.Hour)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handleOrdered must stop waiting for backoff, when ctx is done")
+	}
+	if calls != 1 {
+		t.Fatalf("handler must not be retried after stop, called %v times", calls)
+	}
+}
+
+func TestHandleOrderedLeaseCancelsHandler(t *testing.T) {
+	q := newTestQueue(KafkaCfg{TopicLeases: map[string]time.Duration{"orders": 30 * time.Millisecond}})
+	q.ordered["orders"] = 1
+	msg := newTestMessage(q, "orders", 0, 1, "k")
+
+	var calls int
+	cancelled := false
+	q.handleOrdered(context.Background(), "orders", msg, func(ctx context.Context, m *Message) error {
+		calls++
+		if calls > 1 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			cancelled = true
+			return ctx.Err()
+		case <-time.After(time.Second):
+			return nil
+		}
+	}, time.Millisecond)
+	if !cancelled {
+		t.Fatal("expired lease must cancel handler")
+	}
+	if calls != 2 {
+		t.Fatalf("message must be retried in place after lease expiration, called %v times", calls)
+	}
+	if msg.lease.isExpired() {
+		t.Fatal("lease of ordered message must not be expired, message isn't nacked")
+	}
+	if err := msg.ExtendLease(time.Second); err != nil {
+		t.Fatalf("extend lease of acked message must do nothing, got %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package kafkaadapt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+//inflightCounter counts messages, which were fetched, but not acked/nacked yet.
+//auto-acked messages, read without consumer group, are not counted
+type inflightCounter struct {
+	n int
+	//closed while there are no in-flight messages
+	idle chan struct{}
+
+	m sync.Mutex
+}
+
+func newInflightCounter() *inflightCounter {
+	c := &inflightCounter{idle: make(chan struct{})}
+	close(c.idle)
+	return c
+}
+
+func (c *inflightCounter) add() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.n == 0 {
+		c.idle = make(chan struct{})
+	}
+	c.n++
+}
+
+func (c *inflightCounter) done() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.n--
+	if c.n == 0 {
+		close(c.idle)
+	}
+}
+
+func (c *inflightCounter) count() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.n
+}
+
+//wait blocks until there are no in-flight messages or ctx is done
+func (c *inflightCounter) wait(ctx context.Context) error {
+	c.m.Lock()
+	idle := c.idle
+	c.m.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//ReaderUnregister stops reading topic with background context set, see ReaderUnregisterWithCtx
+func (q *Queue) ReaderUnregister(topic string) error {
+	return q.ReaderUnregisterWithCtx(context.Background(), topic)
+}
+
+//ReaderUnregisterWithCtx stops reading topic (and its retry topics) or pattern (and all its topics),
+//waits until in-flight messages are acked/nacked and producers exit, closes readers, leaving consumer group, and writers of retry topics.
+//Returns error if ctx was closed before all of it was done.
+func (q *Queue) ReaderUnregisterWithCtx(ctx context.Context, topic string) error {
+	members, errs, err := q.unregisterReaders(ctx, topic)
+	if err != nil {
+		return err
+	}
+	//участник выходит из группы после отзыва партиций, который ждет adminLock, поэтому ждем его без блокировки
+	for _, m := range members {
+		err := m.wait(ctx)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("cant unregister reader of %v: %v", topic, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+//unregisterReaders stops and drains readers of topic, consumer group members of its topics are stopped, but not waited.
+//returns errors of draining, err is returned only if topic isn't registered.
+func (q *Queue) unregisterReaders(ctx context.Context, topic string) (members []*groupMember, errs []string, err error) {
+	q.adminLock.Lock()
+	defer q.adminLock.Unlock()
+	q.m.Lock()
+	msgChan, ok := q.messages[topic]
+	if !ok {
+		q.m.Unlock()
+		return nil, nil, fmt.Errorf("there is no such topic declared in config: %v", topic)
+	}
+	var trs []*topicReaders
+	var tiers []string
+	for _, t := range q.readers {
+		if t.name != topic {
+			continue
+		}
+		trs = append(trs, t)
+		if _, ok := q.retryTiers[t.topic]; ok {
+			tiers = append(tiers, t.topic)
+			delete(q.retryTiers, t.topic)
+		}
+	}
+	for _, t := range trs {
+		t.halt()
+		delete(q.readers, t.topic)
+		if m, ok := q.members[t.topic]; ok {
+			members = append(members, m)
+			delete(q.members, t.topic)
+		}
+	}
+	delete(q.paused, topic)
+	delete(q.messages, topic)
+	delete(q.patterns, topic)
+	q.m.Unlock()
+
+	q.offsetLock.Lock()
+	for _, t := range trs {
+		delete(q.readerOffsets, t.topic)
+	}
+	q.offsetLock.Unlock()
+
+	drained := true
+	for _, t := range trs {
+		err := q.drainReaders(ctx, t)
+		if err != nil {
+			drained = false
+			errs = append(errs, err.Error())
+		}
+		q.acks.forget(t.topic)
+	}
+	//автоподтвержденные сообщения не считаются in-flight, продюсер может еще отправлять такое в канал
+	for _, t := range trs {
+		err := waitProducers(ctx, t)
+		if err != nil {
+			drained = false
+			errs = append(errs, err.Error())
+		}
+	}
+	//участники группы останавливаются после того, как подтверждения in-flight сообщений закоммичены их поколениями
+	for _, m := range members {
+		m.halt()
+	}
+	//канал закрываем только если никто больше не может в него писать, чтобы разбудить ожидающих GetWithCtx
+	if drained {
+		close(msgChan)
+	}
+	for _, tier := range tiers {
+		err := q.WriterUnregisterWithCtx(ctx, tier)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return members, errs, nil
+}
+
+//drainReaders waits for in-flight messages of halted topic and closes its readers
+func (q *Queue) drainReaders(ctx context.Context, tr *topicReaders) error {
+	readers, err := q.collectReaders(ctx, tr)
+	closeReaders(q.logger, readers)
+	return err
+}
+
+//waitProducers waits until producers of halted topic exit
+func waitProducers(ctx context.Context, tr *topicReaders) error {
+	done := make(chan struct{})
+	go func() {
+		tr.producers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("producers of %v are still running: %v", tr.topic, ctx.Err())
+	}
+}
+
+//collectReaders waits for in-flight messages of halted topic and takes all its readers from readers channel.
+//returns collected readers even on error.
+func (q *Queue) collectReaders(ctx context.Context, tr *topicReaders) ([]*kafka.Reader, error) {
+	err := tr.inflight.wait(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%v messages of %v are still in-flight: %v", tr.inflight.count(), tr.topic, err)
+	}
+	q.m.RLock()
+	count := tr.count
+	q.m.RUnlock()
+	readers := make([]*kafka.Reader, 0, count)
+	for len(readers) < count {
+		select {
+		case r := <-tr.rch:
+			readers = append(readers, r)
+		case <-ctx.Done():
+			return readers, fmt.Errorf("%v readers of %v are still busy: %v", count-len(readers), tr.topic, ctx.Err())
+		}
+	}
+	return readers, nil
+}
+
+//WriterUnregister stops writing to topic with background context set, see WriterUnregisterWithCtx
+func (q *Queue) WriterUnregister(topic string) error {
+	return q.WriterUnregisterWithCtx(context.Background(), topic)
+}
+
+//WriterUnregisterWithCtx removes topic writers, waiting until their pending writes are flushed
+func (q *Queue) WriterUnregisterWithCtx(ctx context.Context, topic string) error {
+	q.m.Lock()
+	wch, ok := q.writers[topic]
+	count := q.writerCounts[topic]
+	delete(q.writers, topic)
+	delete(q.writerCounts, topic)
+	q.m.Unlock()
+	if !ok {
+		return fmt.Errorf("there is no such topic declared in config: %v", topic)
+	}
+	q.closeRouteWriter(topic)
+
+	for i := 0; i < count; i++ {
+		var w *kafka.Writer
+		select {
+		case w = <-wch:
+		case <-ctx.Done():
+			return fmt.Errorf("%v writers of %v are not closed: %v", count-i, topic, ctx.Err())
+		}
+		err := w.Close()
+		if err != nil {
+			q.logger.Errorf("err during writer closing: %v", err)
+		}
+	}
+	return nil
+}
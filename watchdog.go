@@ -0,0 +1,238 @@
+package kafkaadapt
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultWatchdogInterval     = 10 * time.Second
+	defaultWatchdogStallTimeout = 5 * time.Minute
+)
+
+type StallEventKind int
+
+const (
+	//topic has no progress during StallTimeout, while it has lag or unacked messages
+	TopicStalled StallEventKind = iota
+	//topic has no messages to read during StallTimeout, it isn't reported for topics with unknown lag
+	TopicIdle
+	//topic makes progress again after TopicStalled
+	TopicRecovered
+)
+
+func (k StallEventKind) String() string {
+	switch k {
+	case TopicStalled:
+		return "topic stalled"
+	case TopicIdle:
+		return "topic idle"
+	case TopicRecovered:
+		return "topic recovered"
+	}
+	return "unknown stall event"
+}
+
+type StallEvent struct {
+	Kind  StallEventKind
+	Topic string
+	//cause of stall for TopicStalled
+	Reason string
+	//total lag of topic, -1 if it's unknown
+	Lag int64
+	//count of fetched, but not acked/nacked messages
+	InFlight int
+	Stats    TopicStats
+	//true if stalled readers were recreated
+	Recycled bool
+}
+
+//WatchdogConfig enables watching progress of read topics, see KafkaCfg.Watchdog
+type WatchdogConfig struct {
+	//default is 10s
+	Interval time.Duration
+	//time without progress, after which topic is considered stalled or idle
+	//default is 5 minutes
+	StallTimeout time.Duration
+
+	//recreates topic readers, when fetching is stalled with lag.
+	//readers, held by unacked messages, are not recycled, use KafkaCfg.TopicLeases for them
+	RecycleReaders bool
+
+	//called on every stall event, events are logged by Logger if it's nil
+	OnEvent func(StallEvent)
+}
+
+type topicWatchState struct {
+	//time when topic was seen by watchdog first time, used instead of zero stats times
+	since  time.Time
+	stall  bool
+	idle   bool
+	reason string
+}
+
+//watch checks progress of read topics until queue is closing
+func (q *Queue) watch() {
+	cfg := *q.cfg.Watchdog
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultWatchdogInterval
+	}
+	if cfg.StallTimeout <= 0 {
+		cfg.StallTimeout = defaultWatchdogStallTimeout
+	}
+	states := make(map[string]*topicWatchState)
+	t := time.NewTicker(cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-q.closing:
+			return
+		case <-t.C:
+		}
+		q.m.RLock()
+		trs := make(map[string]*topicReaders, len(q.readers))
+		for topic, tr := range q.readers {
+			trs[topic] = tr
+		}
+		q.m.RUnlock()
+		for topic := range states {
+			if _, ok := trs[topic]; !ok {
+				delete(states, topic)
+			}
+		}
+		for topic, tr := range trs {
+			state, ok := states[topic]
+			if !ok {
+				state = &topicWatchState{since: time.Now()}
+				states[topic] = state
+			}
+			q.checkTopic(cfg, tr, state)
+		}
+	}
+}
+
+//checkTopic tells idle topic from stalled one and reports changes of its state
+func (q *Queue) checkTopic(cfg WatchdogConfig, tr *topicReaders, state *topicWatchState) {
+	now := time.Now()
+	stats := q.stats.topic(tr.topic).snapshot()
+	inflight := tr.inflight.count()
+	lag := int64(-1)
+	if l, _, err := q.consumerLag(tr.topic); err == nil {
+		lag = l.Total
+	}
+	needack := q.cfg.ConsumerGroupID != "" || q.storesOffsets()
+	if lag < 0 && needack {
+		//без лага нельзя отличить простой от зависания, состояние не меняем до следующей проверки
+		return
+	}
+	//время с последнего события, но не больше, чем с начала наблюдения за топиком
+	since := func(t time.Time) time.Duration {
+		if t.Before(state.since) {
+			t = state.since
+		}
+		return now.Sub(t)
+	}
+
+	var reason string
+	idle := false
+	switch {
+	case stats.Delayed > 0:
+		//сообщения ретрай-топика ждут своего времени, это не зависание
+	case inflight > 0 && needack && since(stats.LastAcked) > cfg.StallTimeout:
+		if stats.LastDelivered.Before(stats.LastFetched) && since(stats.LastDelivered) > cfg.StallTimeout {
+			reason = fmt.Sprintf("%v fetched messages are not taken by GetWithCtx", inflight)
+		} else {
+			reason = fmt.Sprintf("%v messages are not acked/nacked", inflight)
+		}
+	case !needack && stats.LastDelivered.Before(stats.LastFetched) && since(stats.LastFetched) > cfg.StallTimeout:
+		//без консумергруппы сообщения не считаются in-flight, зависшую выдачу видно только по временам
+		reason = "fetched message is not taken by GetWithCtx"
+	case inflight == 0 && lag > 0 && since(stats.LastFetched) > cfg.StallTimeout:
+		reason = fmt.Sprintf("messages are not fetched, lag is %v", lag)
+	case inflight == 0 && lag == 0 && since(stats.LastFetched) > cfg.StallTimeout:
+		idle = true
+	}
+
+	event := StallEvent{
+		Topic:    tr.topic,
+		Reason:   reason,
+		Lag:      lag,
+		InFlight: inflight,
+		Stats:    stats,
+	}
+	switch {
+	case reason != "":
+		if state.stall && state.reason == reason {
+			return
+		}
+		state.stall, state.idle, state.reason = true, false, reason
+		event.Kind = TopicStalled
+		if cfg.RecycleReaders && inflight == 0 {
+			err := q.recycleReaders(tr.topic, cfg.Interval)
+			if err != nil {
+				q.logger.Errorf("cant recycle readers of %v: %v", tr.topic, err)
+			} else {
+				event.Recycled = true
+				//после пересоздания ридеров даем им StallTimeout на восстановление
+				state.since = time.Now()
+				state.stall = false
+			}
+		}
+	case idle:
+		if state.idle {
+			return
+		}
+		state.idle, state.stall, state.reason = true, false, ""
+		event.Kind = TopicIdle
+	default:
+		state.idle = false
+		if !state.stall {
+			return
+		}
+		state.stall, state.reason = false, ""
+		event.Kind = TopicRecovered
+	}
+	q.reportStall(cfg, event)
+}
+
+//recycleReaders recreates readers of halted topic, waiting for them not longer than timeout
+func (q *Queue) recycleReaders(topic string, timeout time.Duration) error {
+	q.adminLock.Lock()
+	defer q.adminLock.Unlock()
+	q.m.RLock()
+	tr, ok := q.readers[topic]
+	q.m.RUnlock()
+	if !ok {
+		return fmt.Errorf("there is no such topic declared in config: %v", topic)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	//остановка продюсеров прерывает зависшие FetchMessage и возвращает ридеры в канал
+	tr.halt()
+	readers, err := q.collectReaders(ctx, tr)
+	for _, r := range readers {
+		if err == nil {
+			r = q.recreateReader(tr, r)
+		}
+		tr.rch <- r
+	}
+	q.restartReaders(tr)
+	return err
+}
+
+func (q *Queue) reportStall(cfg WatchdogConfig, e StallEvent) {
+	if cfg.OnEvent != nil {
+		defer q.recoverHook("WatchdogConfig.OnEvent")
+		cfg.OnEvent(e)
+		return
+	}
+	switch e.Kind {
+	case TopicStalled:
+		q.logger.Errorf("%v: %v: %v, last fetched at %v, delivered at %v, acked at %v, readers recycled: %v",
+			e.Topic, e.Kind, e.Reason, e.Stats.LastFetched, e.Stats.LastDelivered, e.Stats.LastAcked, e.Recycled)
+	default:
+		q.logger.Infof("%v: %v", e.Topic, e.Kind)
+	}
+}